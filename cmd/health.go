@@ -0,0 +1,32 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"endpoint-visualiser-server/pkg/health"
+)
+
+// startup is the server's own progress towards serving, reported alongside its subsystems.
+// The config has always been loaded by the time anyone can ask.
+type startup struct {
+	configPath   string
+	started      atomic.Bool // Everything waited on by synchStart is up.
+	listening    atomic.Bool
+	shuttingDown atomic.Bool
+}
+
+func (s *startup) Live() health.Status {
+	return health.Up("process up")
+}
+
+func (s *startup) Ready() health.Status {
+	switch {
+	case s.shuttingDown.Load():
+		return health.Down("shutting down")
+	case !s.started.Load():
+		return health.Down("config loaded from " + s.configPath + ", subsystems starting")
+	case !s.listening.Load():
+		return health.Down("config loaded from " + s.configPath + ", HTTP listener not bound")
+	}
+	return health.Up("config loaded from " + s.configPath + ", HTTP listener bound")
+}
@@ -1,19 +1,34 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"endpoint-visualiser-server/pkg/clienthandler/rest"
 	"endpoint-visualiser-server/pkg/clienthandler/websocket"
 	"endpoint-visualiser-server/pkg/endpoint"
 	"endpoint-visualiser-server/pkg/event"
+	"endpoint-visualiser-server/pkg/health"
+	"endpoint-visualiser-server/pkg/journal"
 	"endpoint-visualiser-server/pkg/keyboard"
+	"endpoint-visualiser-server/pkg/logging"
+	"endpoint-visualiser-server/pkg/metrics"
+	"endpoint-visualiser-server/pkg/replay"
+	"endpoint-visualiser-server/pkg/scenario"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -21,62 +36,286 @@ import (
 
 func main() {
 
-	logfile, err := os.OpenFile("log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	scenarioPath := flag.String("scenario", "", "Path to a scenario file to run at startup")
+	configFlag := flag.String("config", "", fmt.Sprintf("Path to the config file (env %s, default %s)", configPathEnv, defaultConfigFileName))
+	givenSettings := settingFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n       %s [flags] validate [config file]\n       %s [flags] replay [-speed N] <journal file>\n\n", os.Args[0], os.Args[0], os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Settings are taken from flags first, then environment variables, then the config file's \"server\" section.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	configPath := resolveConfigPath(*configFlag)
+	if flag.Arg(0) == "validate" {
+		if flag.NArg() > 1 {
+			configPath = flag.Arg(1)
+		}
+		runValidate(configPath, *scenarioPath)
+		return
+	}
+
+	var recording *replayArgs
+	if flag.Arg(0) == "replay" {
+		args, err := parseReplayArgs(flag.Args()[1:])
+		if err != nil {
+			fmt.Printf("Invalid replay: %s\n", err.Error())
+			os.Exit(2)
+		}
+		recording = &args
+	}
+
+	config, err := ReadConfig(configPath)
 	if err != nil {
-		fmt.Printf("Couldn't initialise log file: %s", err.Error())
+		fmt.Printf("Failed To Read Config: %s\n", err.Error())
 		os.Exit(1)
 	}
-	logger := log.New(logfile, "", 0)
 
-	config, err := ReadConfig()
+	serverSettings, err := resolveSettings(config.Server, givenSettings())
 	if err != nil {
-		fmt.Printf("Failed To Read Config")
+		fmt.Printf("Invalid Settings: %s\n", err.Error())
 		os.Exit(1)
 	}
 
+	logger, logCloser, err := openLog(serverSettings)
+	if err != nil {
+		fmt.Printf("Couldn't initialise log: %s", err.Error())
+		os.Exit(1)
+	}
+
+	ctx, shutdown := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Info("Shutting down", "signal", sig.String())
+		shutdown()
+		sig = <-signals
+		logger.Warn("Exiting without waiting for shutdown to finish", "signal", sig.String())
+		fmt.Printf("Forced exit\n")
+		os.Exit(1)
+	}()
+
+	sessionJournal, err := openJournal(serverSettings, logger)
+	if err != nil {
+		fmt.Printf("Couldn't open journal: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	var startScenario *scenario.Scenario
+	seedOpts := []endpoint.ManagerOption{}
+	switch {
+	case recording != nil:
+		s, seed, err := replay.Load(recording.path, recording.speed)
+		if err != nil {
+			fmt.Printf("Failed To Read Recording: %s\n", err.Error())
+			os.Exit(1)
+		}
+		startScenario = &s
+		seedOpts = append(seedOpts, endpoint.WithSeed(seed))
+	case *scenarioPath != "":
+		s, err := loadScenario(*scenarioPath, config)
+		if err != nil {
+			fmt.Printf("Failed To Read Scenario: %s", err.Error())
+			os.Exit(1)
+		}
+		startScenario = &s
+	}
+
 	eventChan := make(chan event.Event)
+	simulatorMetrics := metrics.New()
 
 	webSocketManager := websocket.New(
 		websocket.WithClientRegisterer,
+		websocket.WithEventChannel(eventChan),
 		websocket.WithLogger(logger),
+		websocket.WithMetrics(simulatorMetrics),
 	)
 
-	restManager := rest.New(
-		rest.WithConfig(config.Endpoints),
-		rest.WithLogger(logger),
-	)
-
-	endpointManager := endpoint.NewManager(eventChan,
+	endpointManager := endpoint.NewManager(eventChan, append([]endpoint.ManagerOption{
 		endpoint.WithConfig(copyEnpointConfig(config.Endpoints)),
 		endpoint.WithWebSocketTarget(webSocketManager),
+		endpoint.WithImpairmentProfiles(config.ImpairmentProfiles),
 		endpoint.WithLogger(logger),
-	)
+		endpoint.WithMetrics(simulatorMetrics),
+		endpoint.WithJournal(sessionJournal),
+		endpoint.WithStatsInterval(time.Duration(*serverSettings.StatsInterval) * time.Millisecond),
+	}, seedOpts...)...)
+	webSocketManager.OnSubscribersChanged(endpointManager.SubscribersChanged)
+
+	scenarioOpts := []scenario.RunnerOption{
+		scenario.WithEndpoints(endpointIDs(config.Endpoints)),
+		scenario.WithLogger(logger),
+	}
+	if startScenario != nil {
+		scenarioOpts = append(scenarioOpts, scenario.WithScenario(*startScenario))
+	}
+	scenarioRunner := scenario.NewRunner(eventChan, scenarioOpts...)
 
 	keyListener, err := keyboard.NewListener(eventChan,
 		keyboard.WithConfig(config.KeyProfiles),
+		keyboard.WithAttachments(profileAttachments(config)),
+		keyboard.WithQuit(shutdown),
 		keyboard.WithLogger(logger),
 	)
 
 	if err != nil {
-		log.Printf("KeyListener Startup Failed. Error: %s", err.Error())
+		fmt.Printf("KeyListener Startup Failed. Error: %s", err.Error())
+		os.Exit(1)
 	}
 
+	progress := &startup{configPath: configPath}
+	restOpts := []rest.ManagerOption{
+		rest.WithConfig(config.Endpoints),
+		rest.WithEventChannel(eventChan),
+		rest.WithStatusProvider(endpointManager),
+		rest.WithScenarioController(scenarioRunner),
+		rest.WithKeyboardController(keyListener),
+		rest.WithHealthChecks(
+			health.Subsystem{Name: "server", Checker: progress},
+			health.Subsystem{Name: "endpointManager", Checker: endpointManager},
+			health.Subsystem{Name: "websocketManager", Checker: webSocketManager},
+			health.Subsystem{Name: "keyboardListener", Checker: keyListener},
+		),
+		rest.WithLogger(logger),
+	}
+	// Only the journal's own recordings can be replayed, there's nothing to replay without one.
+	if serverSettings.Journal != "" {
+		restOpts = append(restOpts, rest.WithReplayer(replay.NewPlayer(scenarioRunner, endpointManager,
+			replay.WithDirectory(filepath.Dir(serverSettings.Journal)),
+			replay.WithLogger(logger),
+		)))
+	}
+	restManager := rest.New(restOpts...)
+
 	router := mux.NewRouter()
 	router.HandleFunc("/endpoints", restManager.EndpointDiscoveryHandler).Methods("GET")
-	router.Path("/websocketRegistration/{id:[0-9]+}").HandlerFunc(webSocketManager.Handler())
+	router.HandleFunc("/endpoints/{id:[0-9]+}/state", restManager.EndpointStateHandler).Methods("GET")
+	router.HandleFunc("/endpoints/{id:[0-9]+}/events/{eventName}", restManager.EventHandler).Methods("POST")
+	router.HandleFunc("/scenario", restManager.ScenarioStatusHandler).Methods("GET")
+	router.HandleFunc("/scenario/{action:start|pause|stop}", restManager.ScenarioControlHandler).Methods("POST")
+	router.HandleFunc("/keypressProfiles", restManager.KeyPressProfilesHandler).Methods("GET")
+	router.HandleFunc("/keypressProfiles/{id:[0-9]+}/endpoints", restManager.KeyPressProfileAttachHandler).Methods("PUT")
+	if serverSettings.Journal != "" {
+		router.HandleFunc("/replay", restManager.ReplayHandler).Methods("POST")
+	}
+	router.HandleFunc("/metrics", simulatorMetrics.Handler).Methods("GET")
+	router.HandleFunc("/healthz", restManager.HealthHandler).Methods("GET")
+	router.HandleFunc("/readyz", restManager.ReadinessHandler).Methods("GET")
+	router.Path(strings.TrimSuffix(serverSettings.WebsocketPath, "/") + "/{id:[0-9]+}").HandlerFunc(webSocketManager.Handler())
 
 	synchStart := &sync.WaitGroup{}
-	endpointManager.Start(synchStart)
-	keyListener.Start(synchStart)
+	endpointManager.Start(ctx, synchStart)
+	if *serverSettings.Keyboard {
+		keyListener.Start(ctx, synchStart)
+	}
 	synchStart.Wait()
+	progress.started.Store(true)
+
+	if startScenario != nil {
+		scenarioRunner.Start()
+	}
+
+	configReloader := &reloader{
+		configPath:       configPath,
+		logger:           logger,
+		endpointManager:  endpointManager,
+		restManager:      restManager,
+		keyListener:      keyListener,
+		scenarioRunner:   scenarioRunner,
+		webSocketManager: webSocketManager,
+	}
+	go configReloader.watch(ctx)
+
+	server := &http.Server{
+		Addr:     serverSettings.Address,
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+		Handler:  handlers.CORS(handlers.AllowedMethods([]string{"GET", "POST", "PUT"}), handlers.AllowedOrigins(serverSettings.CORSOrigins))(router),
+	}
+	go func() {
+		fmt.Printf("Listening on %s\n", serverSettings.Address)
+		err := serve(server, serverSettings, &progress.listening)
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("HTTP server failed", logging.Err, err)
+			shutdown()
+		}
+	}()
+
+	<-ctx.Done()
+	fmt.Printf("Shutting down...\n")
+	progress.shuttingDown.Store(true)
+	gracefulShutdown(logger, scenarioRunner, endpointManager, webSocketManager, server)
+	sessionJournal.Close()
+	logCloser.Close()
+}
 
-	fmt.Printf("\nListening on port 3031")
-	log.Fatal(http.ListenAndServe(":3031", handlers.CORS(handlers.AllowedMethods([]string{"GET", "POST"}), handlers.AllowedOrigins([]string{"*"}))(router)))
+// openJournal is nil, recording nothing, unless the settings give a journal path. SIGUSR1 rotates it.
+func openJournal(s ServerSettings, logger logging.Logger) (*journal.Journal, error) {
+	if s.Journal == "" {
+		return nil, nil
+	}
+	j, err := journal.Open(s.Journal, journal.WithMaxBytes(int64(s.JournalMaxMB)<<20), journal.WithLogger(logger))
+	if err != nil {
+		return nil, err
+	}
+
+	rotate := make(chan os.Signal, 1)
+	signal.Notify(rotate, syscall.SIGUSR1)
+	go func() {
+		for range rotate {
+			if err := j.Rotate(); err != nil {
+				logger.Error("Couldn't rotate journal", logging.Err, err)
+			}
+		}
+	}()
+	return j, nil
+}
+
+// serve binds the listener itself, rather than leaving it to ListenAndServe, so readiness can
+// report when it's bound.
+func serve(server *http.Server, s ServerSettings, listening *atomic.Bool) error {
+	address := server.Addr
+	if address == "" {
+		address = ":http"
+		if s.TLSCert != "" {
+			address = ":https"
+		}
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	listening.Store(true)
+	defer listening.Store(false)
+	if s.TLSCert != "" {
+		return server.ServeTLS(listener, s.TLSCert, s.TLSKey)
+	}
+	return server.Serve(listener)
+}
+
+const shutdownTimeout = 15 * time.Second
+
+// gracefulShutdown drains traffic and says goodbye to every client before the HTTP server goes.
+func gracefulShutdown(logger logging.Logger, scenarioRunner *scenario.Runner, endpointManager *endpoint.Manager, webSocketManager *websocket.Manager, server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	scenarioRunner.Stop()
+	if err := endpointManager.Wait(ctx); err != nil {
+		logger.Warn("Gave up waiting for in-flight traffic", logging.Err, err)
+	}
+	webSocketManager.Close()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warn("HTTP server shutdown failed", logging.Err, err)
+	}
+	logger.Info("Shutdown complete")
 }
 
 type Config struct {
-	Endpoints   []rest.DiscoverableEndpoint `json:"endpoints"`
-	KeyProfiles []keyboard.KeyPressProfile  `json:"keypressProfiles"`
+	Endpoints          []rest.DiscoverableEndpoint  `json:"endpoints"`
+	KeyProfiles        []keyboard.KeyPressProfile   `json:"keypressProfiles"`
+	ImpairmentProfiles []endpoint.ImpairmentProfile `json:"impairmentProfiles"`
+	Server             ServerSettings               `json:"server,omitempty"`
 }
 
 func copyEnpointConfig(deps []rest.DiscoverableEndpoint) []endpoint.ManagableEndpoint {
@@ -87,19 +326,61 @@ func copyEnpointConfig(deps []rest.DiscoverableEndpoint) []endpoint.ManagableEnd
 			Title:    dep.Title,
 			MaxConns: dep.MaxConns,
 		}
+		if dep.Generator != nil {
+			managableEndpoints[i].Generator = *dep.Generator
+		}
 	}
 	return managableEndpoints
 }
 
-func ReadConfig() (Config, error) {
-	configFile, err := os.Open("config.json")
+// profileAttachments lists the endpoints attached to each keypress profile, by profile ID: those
+// the profile lists, then those naming the profile.
+func profileAttachments(config Config) map[int][]int {
+	attachments := make(map[int][]int)
+	attach := func(profile, endpoint int) {
+		for _, id := range attachments[profile] {
+			if id == endpoint {
+				return
+			}
+		}
+		attachments[profile] = append(attachments[profile], endpoint)
+	}
+	for _, profile := range config.KeyProfiles {
+		for _, id := range profile.Endpoints {
+			attach(profile.ID, id)
+		}
+	}
+	for _, dep := range config.Endpoints {
+		if dep.KeyPressProfile != 0 {
+			attach(dep.KeyPressProfile, dep.ID)
+		}
+	}
+	return attachments
+}
+
+func endpointIDs(deps []rest.DiscoverableEndpoint) []int {
+	ids := make([]int, len(deps))
+	for i, dep := range deps {
+		ids[i] = dep.ID
+	}
+	return ids
+}
+
+const defaultConfigFileName = "config.json"
+
+// ReadConfig reads and validates the config file at path.
+func ReadConfig(path string) (Config, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return Config{}, err
 	}
-	defer configFile.Close()
 
-	fileDataBytes, _ := ioutil.ReadAll(configFile)
 	var config Config
-	err = json.Unmarshal(fileDataBytes, &config)
-	return config, err
+	if err := json.Unmarshal(data, &config); err != nil {
+		return Config{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := validateConfig(data, config); err != nil {
+		return Config{}, err
+	}
+	return config, nil
 }
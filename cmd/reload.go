@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"endpoint-visualiser-server/pkg/clienthandler/rest"
+	"endpoint-visualiser-server/pkg/clienthandler/websocket"
+	"endpoint-visualiser-server/pkg/endpoint"
+	"endpoint-visualiser-server/pkg/keyboard"
+	"endpoint-visualiser-server/pkg/logging"
+	"endpoint-visualiser-server/pkg/scenario"
+)
+
+const configPollInterval = 2 * time.Second
+
+// ConfigChangedMessage tells every connected client the endpoint set may have changed,
+// so they should rediscover. A changed generator applies from the endpoint's next
+// StartTrafficEvent, but a changed maxConns only once the endpoint reconnects.
+type ConfigChangedMessage struct {
+	RequestID string                      `json:"id"`
+	Endpoints []rest.DiscoverableEndpoint `json:"endpoints"`
+	Reconnect []int                       `json:"reconnect,omitempty"` // Connected endpoints still on their old maxConns.
+}
+
+const configChanged = "ConfigChanged"
+
+// reloader applies a changed config file to everything that was built from it.
+type reloader struct {
+	configPath       string
+	logger           logging.Logger
+	endpointManager  *endpoint.Manager
+	restManager      *rest.RestManager
+	keyListener      *keyboard.Listener
+	scenarioRunner   *scenario.Runner
+	webSocketManager *websocket.Manager
+}
+
+// watch reloads on SIGHUP, or when the config file's modification time changes, until ctx is done.
+func (r *reloader) watch(ctx context.Context) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	lastModified := configModTime(r.configPath)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+			r.logger.Info("Received SIGHUP, reloading config")
+			lastModified = configModTime(r.configPath)
+			r.reload()
+		case <-ticker.C:
+			modified := configModTime(r.configPath)
+			if modified.Equal(lastModified) {
+				continue
+			}
+			r.logger.Info("Config file changed, reloading", "path", r.configPath)
+			lastModified = modified
+			r.reload()
+		}
+	}
+}
+
+// reload leaves everything as it was if the new config can't be read or isn't valid.
+func (r *reloader) reload() {
+	config, err := ReadConfig(r.configPath)
+	if err != nil {
+		r.logger.Error("Not reloading, bad config", logging.Err, err)
+		return
+	}
+	if err := r.keyListener.Reconfigure(config.KeyProfiles, profileAttachments(config)); err != nil {
+		r.logger.Error("Not reloading, invalid key profiles", logging.Err, err)
+		return
+	}
+
+	endpoints := copyEnpointConfig(config.Endpoints)
+	reconnect := r.endpointManager.MustReconnect(endpoints)
+	for _, id := range reconnect {
+		r.logger.Warn("Endpoint must reconnect for its new maxConns to apply", logging.EndpointID, id)
+	}
+	r.endpointManager.Reconfigure(endpoints, config.ImpairmentProfiles)
+	r.scenarioRunner.SetEndpoints(endpointIDs(config.Endpoints))
+	r.restManager.SetConfig(config.Endpoints)
+
+	if err := r.webSocketManager.Broadcast(ConfigChangedMessage{configChanged, config.Endpoints, reconnect}); err != nil {
+		r.logger.Warn("Couldn't notify clients of config change", logging.Err, err)
+	}
+	r.logger.Info("Config reloaded", "endpoints", len(config.Endpoints))
+}
+
+// configModTime is zero if the config file can't be stat'ed, so it reloads once it's back.
+func configModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
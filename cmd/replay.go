@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+
+	"endpoint-visualiser-server/pkg/replay"
+)
+
+// replayArgs are what follows the replay subcommand.
+type replayArgs struct {
+	path  string
+	speed float64
+}
+
+func parseReplayArgs(args []string) (replayArgs, error) {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	speed := flags.Float64("speed", 1, "How many times faster than recorded to replay, only 1 is supported")
+	if err := flags.Parse(args); err != nil {
+		return replayArgs{}, err
+	}
+	if flags.NArg() != 1 {
+		return replayArgs{}, errors.New("expected one journal file to replay")
+	}
+	if *speed != 1 {
+		return replayArgs{}, replay.ErrBadSpeed
+	}
+	return replayArgs{path: flags.Arg(0), speed: *speed}, nil
+}
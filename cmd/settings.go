@@ -0,0 +1,262 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"strconv"
+	"strings"
+
+	"endpoint-visualiser-server/pkg/logging"
+)
+
+// ServerSettings are how the server itself runs, as opposed to what it simulates. Each can be
+// set, in order of precedence, by a flag, an environment variable or the "server" section of
+// the config file. The config file's location can only come from a flag or the environment.
+// Changes to these are not picked up when the config is reloaded.
+type ServerSettings struct {
+	Address       string   `json:"address,omitempty"`
+	Log           string   `json:"log,omitempty"` // A file path, "stdout", "stderr" or "syslog".
+	LogFormat     string   `json:"logFormat,omitempty"`
+	LogLevel      string   `json:"logLevel,omitempty"`
+	CORSOrigins   []string `json:"corsOrigins,omitempty"`
+	Keyboard      *bool    `json:"keyboard,omitempty"`
+	TLSCert       string   `json:"tlsCert,omitempty"`
+	TLSKey        string   `json:"tlsKey,omitempty"`
+	WebsocketPath string   `json:"websocketPath,omitempty"`
+	Journal       string   `json:"journal,omitempty"` // Off unless a path is given.
+	JournalMaxMB  int      `json:"journalMaxMB,omitempty"`
+	StatsInterval *int     `json:"statsIntervalMS,omitempty"` // Milliseconds, 0 for no stats.
+}
+
+func defaultServerSettings() ServerSettings {
+	keyboard, statsInterval := true, 5000
+	return ServerSettings{
+		Address:       ":3031",
+		Log:           "log",
+		LogFormat:     logging.TextFormat,
+		LogLevel:      "info",
+		CORSOrigins:   []string{"*"},
+		Keyboard:      &keyboard,
+		WebsocketPath: "/websocketRegistration",
+		StatsInterval: &statsInterval,
+	}
+}
+
+// setting is one overridable server setting, as a flag and an environment variable.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	apply func(s *ServerSettings, value string) error
+}
+
+var settings = []setting{
+	{"addr", "EPVIZ_ADDR", "Address to listen on", func(s *ServerSettings, v string) error {
+		s.Address = v
+		return nil
+	}},
+	{"log", "EPVIZ_LOG", `Where to log: a file path, "stdout", "stderr" or "syslog"`, func(s *ServerSettings, v string) error {
+		s.Log = v
+		return nil
+	}},
+	{"log-format", "EPVIZ_LOG_FORMAT", "Log entries as text or json", func(s *ServerSettings, v string) error {
+		s.LogFormat = v
+		return nil
+	}},
+	{"log-level", "EPVIZ_LOG_LEVEL", "Lowest level to log: debug, info, warn or error", func(s *ServerSettings, v string) error {
+		s.LogLevel = v
+		return nil
+	}},
+	{"cors-origins", "EPVIZ_CORS_ORIGINS", "Comma separated origins allowed to make cross-origin requests", func(s *ServerSettings, v string) error {
+		s.CORSOrigins = splitList(v)
+		return nil
+	}},
+	{"keyboard", "EPVIZ_KEYBOARD", "Whether to listen for keypresses on the terminal", func(s *ServerSettings, v string) error {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		s.Keyboard = &enabled
+		return nil
+	}},
+	{"tls-cert", "EPVIZ_TLS_CERT", "TLS certificate file, serves HTTPS along with -tls-key", func(s *ServerSettings, v string) error {
+		s.TLSCert = v
+		return nil
+	}},
+	{"tls-key", "EPVIZ_TLS_KEY", "TLS private key file", func(s *ServerSettings, v string) error {
+		s.TLSKey = v
+		return nil
+	}},
+	{"ws-path", "EPVIZ_WS_PATH", "Path prefix clients register websockets on, followed by /{endpoint id}", func(s *ServerSettings, v string) error {
+		s.WebsocketPath = v
+		return nil
+	}},
+	{"journal", "EPVIZ_JOURNAL", "Record every event and message sent to clients as JSON Lines to this file (rotate with SIGUSR1)", func(s *ServerSettings, v string) error {
+		s.Journal = v
+		return nil
+	}},
+	{"journal-max-mb", "EPVIZ_JOURNAL_MAX_MB", "Rotate the journal once it reaches this many megabytes, 0 for never", func(s *ServerSettings, v string) error {
+		mb, err := strconv.Atoi(v)
+		if err != nil || mb < 0 {
+			return fmt.Errorf("%q is not a non-negative number of megabytes", v)
+		}
+		s.JournalMaxMB = mb
+		return nil
+	}},
+	{"stats-interval-ms", "EPVIZ_STATS_INTERVAL_MS", "How often to send each endpoint's stats to its clients, 0 for never", func(s *ServerSettings, v string) error {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			return fmt.Errorf("%q is not a non-negative number of milliseconds", v)
+		}
+		s.StatsInterval = &ms
+		return nil
+	}},
+}
+
+const configPathEnv = "EPVIZ_CONFIG"
+
+// settingFlags registers a string flag for every setting, returning the values given on the command line.
+func settingFlags(flags *flag.FlagSet) func() map[string]string {
+	values := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		values[s.flag] = flags.String(s.flag, "", fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	return func() map[string]string {
+		given := make(map[string]string)
+		flags.Visit(func(f *flag.Flag) {
+			if value, ok := values[f.Name]; ok {
+				given[f.Name] = *value
+			}
+		})
+		return given
+	}
+}
+
+// resolveSettings layers the environment, then flags, over the config file and defaults.
+func resolveSettings(fromConfig ServerSettings, fromFlags map[string]string) (ServerSettings, error) {
+	resolved := defaultServerSettings()
+	overlay(&resolved, fromConfig)
+
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok {
+			if err := s.apply(&resolved, value); err != nil {
+				return resolved, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if value, ok := fromFlags[s.flag]; ok {
+			if err := s.apply(&resolved, value); err != nil {
+				return resolved, fmt.Errorf("-%s: %w", s.flag, err)
+			}
+		}
+	}
+
+	if (resolved.TLSCert == "") != (resolved.TLSKey == "") {
+		return resolved, fmt.Errorf("a TLS certificate and key must be given together")
+	}
+	return resolved, nil
+}
+
+func overlay(s *ServerSettings, o ServerSettings) {
+	if o.Address != "" {
+		s.Address = o.Address
+	}
+	if o.Log != "" {
+		s.Log = o.Log
+	}
+	if o.LogFormat != "" {
+		s.LogFormat = o.LogFormat
+	}
+	if o.LogLevel != "" {
+		s.LogLevel = o.LogLevel
+	}
+	if len(o.CORSOrigins) > 0 {
+		s.CORSOrigins = o.CORSOrigins
+	}
+	if o.Keyboard != nil {
+		s.Keyboard = o.Keyboard
+	}
+	if o.TLSCert != "" {
+		s.TLSCert = o.TLSCert
+	}
+	if o.TLSKey != "" {
+		s.TLSKey = o.TLSKey
+	}
+	if o.WebsocketPath != "" {
+		s.WebsocketPath = o.WebsocketPath
+	}
+	if o.Journal != "" {
+		s.Journal = o.Journal
+	}
+	if o.JournalMaxMB != 0 {
+		s.JournalMaxMB = o.JournalMaxMB
+	}
+	if o.StatsInterval != nil {
+		s.StatsInterval = o.StatsInterval
+	}
+}
+
+// resolveConfigPath is the one setting that can't come from the config file.
+func resolveConfigPath(fromFlag string) string {
+	if fromFlag != "" {
+		return fromFlag
+	}
+	if path, ok := os.LookupEnv(configPathEnv); ok && path != "" {
+		return path
+	}
+	return defaultConfigFileName
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// openLog returns a logger as the settings describe, and what to close once logging is done.
+func openLog(s ServerSettings) (*slog.Logger, io.Closer, error) {
+	writer, closer, err := openLogDestination(s.Log)
+	if err != nil {
+		return nil, nil, err
+	}
+	logger, err := logging.New(writer, s.LogFormat, s.LogLevel)
+	if err != nil {
+		closer.Close()
+		return nil, nil, err
+	}
+	return logger, closer, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+func openLogDestination(destination string) (io.Writer, io.Closer, error) {
+	switch destination {
+	case "stdout":
+		return os.Stdout, nopCloser{}, nil
+	case "stderr":
+		return os.Stderr, nopCloser{}, nil
+	case "syslog":
+		writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "epVizSrv")
+		if err != nil {
+			return nil, nil, err
+		}
+		return writer, writer, nil
+	default:
+		logfile, err := os.OpenFile(destination, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, nil, err
+		}
+		return logfile, logfile, nil
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSettingsPrecedence(t *testing.T) {
+
+	fromConfig := ServerSettings{Address: ":1000", Log: "config.log", CORSOrigins: []string{"http://config"}}
+	t.Setenv("EPVIZ_ADDR", ":2000")
+	t.Setenv("EPVIZ_CORS_ORIGINS", "http://env, http://other")
+	t.Setenv("EPVIZ_KEYBOARD", "false")
+
+	resolved, err := resolveSettings(fromConfig, map[string]string{"addr": ":3000"})
+	if err != nil {
+		t.Fatalf("couldn't resolve settings: %s", err)
+	}
+
+	if resolved.Address != ":3000" {
+		t.Errorf("expected the flag to win, got address %s", resolved.Address)
+	}
+	if !reflect.DeepEqual(resolved.CORSOrigins, []string{"http://env", "http://other"}) {
+		t.Errorf("expected the environment to beat the config file, got origins %v", resolved.CORSOrigins)
+	}
+	if resolved.Log != "config.log" {
+		t.Errorf("expected the config file to beat the default, got log %s", resolved.Log)
+	}
+	if *resolved.Keyboard {
+		t.Errorf("expected the keyboard to be disabled from the environment")
+	}
+	if resolved.WebsocketPath != "/websocketRegistration" {
+		t.Errorf("expected the default websocket path, got %s", resolved.WebsocketPath)
+	}
+
+	if _, err := resolveSettings(ServerSettings{}, map[string]string{"tls-cert": "cert.pem"}); err == nil {
+		t.Errorf("expected a TLS certificate without a key to be rejected")
+	}
+	if _, err := resolveSettings(ServerSettings{}, map[string]string{"keyboard": "maybe"}); err == nil {
+		t.Errorf("expected an unparseable boolean to be rejected")
+	}
+}
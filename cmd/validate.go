@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"endpoint-visualiser-server/pkg/endpoint"
+	"endpoint-visualiser-server/pkg/event"
+	"endpoint-visualiser-server/pkg/scenario"
+)
+
+// ConfigProblem is one thing wrong with a config file, at a JSON path like
+// "keypressProfiles[0].Connect".
+type ConfigProblem struct {
+	Path    string
+	Problem string
+}
+
+func (p ConfigProblem) Error() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Problem)
+}
+
+// ConfigProblems is every problem found in a config file.
+type ConfigProblems []ConfigProblem
+
+func (p ConfigProblems) Error() string {
+	lines := make([]string, len(p))
+	for i, problem := range p {
+		lines[i] = problem.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// quitKey is handled by the key listener itself and can't be bound.
+const quitKey = "`"
+
+// validateConfig checks data, which has already been decoded into config, for everything
+// the decoder lets through.
+func validateConfig(data []byte, config Config) error {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	problems := unknownFields("", raw, reflect.TypeOf(config))
+	problems = append(problems, validateEndpoints(config)...)
+	problems = append(problems, validateKeyProfiles(config)...)
+	problems = append(problems, validateImpairmentProfiles(config)...)
+	if (config.Server.TLSCert == "") != (config.Server.TLSKey == "") {
+		problems = append(problems, ConfigProblem{"server", "tlsCert and tlsKey must be given together"})
+	}
+	if config.Server.StatsInterval != nil && *config.Server.StatsInterval < 0 {
+		problems = append(problems, ConfigProblem{"server.statsIntervalMS", "must not be negative"})
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+func validateEndpoints(config Config) (problems ConfigProblems) {
+	seen := make(map[int]int)
+	profiles := make(map[int]bool)
+	for _, profile := range config.KeyProfiles {
+		profiles[profile.ID] = true
+	}
+
+	for i, ep := range config.Endpoints {
+		path := fmt.Sprintf("endpoints[%d]", i)
+		if first, ok := seen[ep.ID]; ok {
+			problems = append(problems, ConfigProblem{path + ".id", fmt.Sprintf("duplicate endpoint id %d, already used by endpoints[%d]", ep.ID, first)})
+		} else {
+			seen[ep.ID] = i
+		}
+		if ep.MaxConns <= 0 {
+			problems = append(problems, ConfigProblem{path + ".maxConns", fmt.Sprintf("must be positive, got %d", ep.MaxConns)})
+		}
+		if ep.KeyPressProfile != 0 && !profiles[ep.KeyPressProfile] {
+			problems = append(problems, ConfigProblem{path + ".keyPressProfile", fmt.Sprintf("no keypress profile has ID %d", ep.KeyPressProfile)})
+		}
+		if ep.Generator != nil {
+			if _, err := endpoint.NewGenerator(*ep.Generator); err != nil {
+				problems = append(problems, ConfigProblem{path + ".generator", err.Error()})
+			}
+		}
+	}
+	return problems
+}
+
+func validateKeyProfiles(config Config) (problems ConfigProblems) {
+	seen := make(map[int]int)
+	endpoints := make(map[int]bool)
+	for _, ep := range config.Endpoints {
+		endpoints[ep.ID] = true
+	}
+	impairments := make(map[string]bool)
+	for _, profile := range config.ImpairmentProfiles {
+		impairments[profile.Name] = true
+	}
+
+	boundAt := make(map[string]string)
+	bind := func(path, key string) {
+		switch {
+		case key == "":
+			return
+		case key == quitKey:
+			problems = append(problems, ConfigProblem{path, fmt.Sprintf("%q is reserved for quitting", key)})
+		case boundAt[key] != "":
+			problems = append(problems, ConfigProblem{path, fmt.Sprintf("key %q is already bound at %s", key, boundAt[key])})
+		default:
+			boundAt[key] = path
+		}
+	}
+
+	for i, profile := range config.KeyProfiles {
+		path := fmt.Sprintf("keypressProfiles[%d]", i)
+		if first, ok := seen[profile.ID]; ok {
+			problems = append(problems, ConfigProblem{path + ".ID", fmt.Sprintf("duplicate profile ID %d, already used by keypressProfiles[%d]", profile.ID, first)})
+		} else {
+			seen[profile.ID] = i
+		}
+		if profile.ID <= 0 {
+			problems = append(problems, ConfigProblem{path + ".ID", fmt.Sprintf("must be positive, got %d, an endpoint's keyPressProfile of 0 means none", profile.ID)})
+		}
+		for j, id := range profile.Endpoints {
+			if !endpoints[id] {
+				problems = append(problems, ConfigProblem{fmt.Sprintf("%s.Endpoints[%d]", path, j), fmt.Sprintf("no endpoint has id %d", id)})
+			}
+		}
+
+		for _, binding := range profile.KeyBindings() {
+			bind(path+"."+binding.Name, binding.Key)
+		}
+		for _, name := range sortedKeys(profile.ImpairmentKeys) {
+			bindingPath := fmt.Sprintf("%s.Impairments.%s", path, name)
+			if !impairments[name] {
+				problems = append(problems, ConfigProblem{bindingPath, fmt.Sprintf("no impairment profile is named %q", name)})
+			}
+			bind(bindingPath, profile.ImpairmentKeys[name])
+		}
+		for _, name := range sortedKeys(profile.EventKeys) {
+			bindingPath := fmt.Sprintf("%s.Events.%s", path, name)
+			if _, err := event.Lookup(name); err != nil {
+				problems = append(problems, ConfigProblem{bindingPath, err.Error()})
+			}
+			bind(bindingPath, profile.EventKeys[name])
+		}
+	}
+	return problems
+}
+
+func validateImpairmentProfiles(config Config) (problems ConfigProblems) {
+	seen := make(map[string]int)
+	for i, profile := range config.ImpairmentProfiles {
+		path := fmt.Sprintf("impairmentProfiles[%d]", i)
+		if err := profile.Validate(); err != nil {
+			problems = append(problems, ConfigProblem{path, err.Error()})
+		}
+		if first, ok := seen[profile.Name]; ok {
+			problems = append(problems, ConfigProblem{path + ".name", fmt.Sprintf("duplicate name %q, already used by impairmentProfiles[%d]", profile.Name, first)})
+		} else {
+			seen[profile.Name] = i
+		}
+	}
+	return problems
+}
+
+// unknownFields walks the raw JSON alongside the type it decodes into, reporting any object
+// key the decoder would silently ignore. Like encoding/json, it matches names case-insensitively.
+func unknownFields(path string, raw interface{}, t reflect.Type) (problems ConfigProblems) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "-" || field.PkgPath != "" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			fields[strings.ToLower(name)] = field.Type
+		}
+		for _, key := range sortedKeys(object) {
+			fieldType, ok := fields[strings.ToLower(key)]
+			if !ok {
+				problems = append(problems, ConfigProblem{joinPath(path, key), "unknown field"})
+				continue
+			}
+			problems = append(problems, unknownFields(joinPath(path, key), object[key], fieldType)...)
+		}
+	case reflect.Slice:
+		array, ok := raw.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, element := range array {
+			problems = append(problems, unknownFields(fmt.Sprintf("%s[%d]", path, i), element, t.Elem())...)
+		}
+	case reflect.Map:
+		object, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for _, key := range sortedKeys(object) {
+			problems = append(problems, unknownFields(joinPath(path, key), object[key], t.Elem())...)
+		}
+	}
+	return problems
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// loadScenario reads the scenario file at path and checks its steps only name endpoints in config.
+func loadScenario(path string, config Config) (scenario.Scenario, error) {
+	s, err := scenario.Load(path)
+	if err != nil {
+		return scenario.Scenario{}, err
+	}
+	if err := s.CheckEndpoints(endpointIDs(config.Endpoints)); err != nil {
+		return scenario.Scenario{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// runValidate is the validate subcommand: check a config file, and the scenario file if there is
+// one, and exit, without starting anything.
+func runValidate(path string, scenarioPath string) {
+	config, err := ReadConfig(path)
+	if err != nil {
+		fmt.Printf("%s is invalid:\n%s\n", path, err.Error())
+		os.Exit(1)
+	}
+	if scenarioPath != "" {
+		if _, err := loadScenario(scenarioPath, config); err != nil {
+			fmt.Printf("%s is invalid:\n%s\n", scenarioPath, err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("%s is valid\n", scenarioPath)
+	}
+	fmt.Printf("%s is valid\n", path)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"endpoint-visualiser-server/pkg/scenario"
+)
+
+func TestValidateConfig(t *testing.T) {
+
+	data := []byte(`{
+		"endpoints": [
+			{"id": 1, "title": "One", "maxConns": 4, "keyPressProfile": 1},
+			{"id": 1, "title": "Also One", "maxConns": 0, "keyPressProfile": 7},
+			{"id": 2, "title": "Two", "maxConns": 4, "generator": {"name": "poisson", "ratePerSecond": 0, "burst": 3}},
+			{"id": 3, "title": "Three", "maxConns": 4, "generator": {"name": "lumpy"}}
+		],
+		"keypressProfiles": [
+			{"ID": 1, "Connect": "1", "Delay500ms:": "2", "Impairments": {"Missing": "3"}},
+			{"ID": 1, "Connect": "1", "Disconnect": "` + "`" + `", "Events": {"JitterEvent:fast": "4"}},
+			{"ID": 0, "Endpoints": [2, 9]}
+		],
+		"impairmentProfiles": [
+			{"name": "Slow", "distribution": "uniform", "minMS": 1, "maxMS": 10, "meanMs": 5}
+		]
+	}`)
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("couldn't decode config: %s", err)
+	}
+
+	var problems ConfigProblems
+	if !errors.As(validateConfig(data, config), &problems) {
+		t.Fatalf("expected problems with the config")
+	}
+
+	want := []string{
+		"keypressProfiles[0].Delay500ms:",
+		"endpoints[1].id",
+		"endpoints[1].maxConns",
+		"endpoints[1].keyPressProfile",
+		"endpoints[2].generator",
+		"endpoints[2].generator.burst",
+		"endpoints[3].generator",
+		"keypressProfiles[0].Impairments.Missing",
+		"keypressProfiles[1].ID",
+		"keypressProfiles[1].Connect",
+		"keypressProfiles[1].Disconnect",
+		"keypressProfiles[1].Events.JitterEvent:fast",
+		"keypressProfiles[2].ID",
+		"keypressProfiles[2].Endpoints[1]",
+	}
+	found := make(map[string]bool)
+	for _, problem := range problems {
+		found[problem.Path] = true
+	}
+	for _, path := range want {
+		if !found[path] {
+			t.Errorf("no problem reported at %s, got:\n%s", path, problems)
+		}
+	}
+	if found["keypressProfiles[2].Endpoints[0]"] {
+		t.Errorf("endpoint 2 exists, got:\n%s", problems)
+	}
+	if found["impairmentProfiles[0].meanMs"] {
+		t.Errorf("field names should match case-insensitively, like encoding/json")
+	}
+}
+
+func TestProfileAttachments(t *testing.T) {
+
+	var config Config
+	if err := json.Unmarshal([]byte(`{
+		"endpoints": [{"id": 1, "keyPressProfile": 1}, {"id": 2, "keyPressProfile": 1}, {"id": 3}],
+		"keypressProfiles": [{"ID": 1, "Endpoints": [3, 2]}, {"ID": 2}]
+	}`), &config); err != nil {
+		t.Fatalf("couldn't decode config: %s", err)
+	}
+
+	want := map[int][]int{1: {3, 2, 1}}
+	if got := profileAttachments(config); !reflect.DeepEqual(got, want) {
+		t.Errorf("got attachments %v, want %v", got, want)
+	}
+}
+
+func TestLoadScenarioChecksEndpoints(t *testing.T) {
+
+	var config Config
+	if err := json.Unmarshal([]byte(`{"endpoints": [{"id": 1}, {"id": 2}]}`), &config); err != nil {
+		t.Fatalf("couldn't decode config: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "scenario.json")
+	write := func(steps string) {
+		if err := os.WriteFile(path, []byte(`{"name": "test", "steps": [`+steps+`]}`), 0o644); err != nil {
+			t.Fatalf("couldn't write scenario: %s", err)
+		}
+	}
+
+	write(`{"at": "0s", "event": "ConnectEvent"}, {"at": "1s", "endpoints": [2], "event": "DelayLongEvent"}`)
+	if _, err := loadScenario(path, config); err != nil {
+		t.Fatalf("expected the scenario to be valid, got %s", err)
+	}
+	write(`{"at": "0s", "event": "ConnectEvent"}, {"at": "1s", "endpoints": [2, 7], "event": "DelayLongEvent"}`)
+	if _, err := loadScenario(path, config); !errors.Is(err, scenario.ErrNoSuchEndpoint) {
+		t.Fatalf("expected endpoint 7 to be rejected, got %v", err)
+	}
+}
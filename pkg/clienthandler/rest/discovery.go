@@ -2,19 +2,38 @@ package rest
 
 import (
 	"encoding/json"
-	"io/ioutil"
-	"log"
+	"fmt"
 	"net/http"
+	"strconv"
+	"sync"
+
+	"endpoint-visualiser-server/pkg/endpoint"
+	"endpoint-visualiser-server/pkg/event"
+	"endpoint-visualiser-server/pkg/health"
+	"endpoint-visualiser-server/pkg/logging"
+
+	"github.com/gorilla/mux"
 )
 
 type RestManager struct {
-	config []DiscoverableEndpoint
-	logger *log.Logger
+	configLock sync.RWMutex
+	config     []DiscoverableEndpoint
+	eventChan  chan<- event.Event
+	status     StatusProvider
+	scenario   ScenarioController
+	keyboard   KeyboardController
+	replayer   Replayer
+	health     []health.Subsystem
+	logger     logging.Logger
+}
+
+// StatusProvider reports the live state of each endpoint. *endpoint.Manager is the real one.
+type StatusProvider interface {
+	EndpointStatus(id int) (endpoint.EndpointStatus, bool)
 }
 
 func New(opts ...ManagerOption) *RestManager {
-	defaultDiscardLogger := log.New(ioutil.Discard, "", 0)
-	manager := &RestManager{logger: defaultDiscardLogger}
+	manager := &RestManager{logger: logging.Discard()}
 	for _, opt := range opts {
 		opt(manager)
 	}
@@ -22,9 +41,17 @@ func New(opts ...ManagerOption) *RestManager {
 }
 
 type DiscoverableEndpoint struct {
-	ID       int    `json:"id"`
-	Title    string `json:"title"`
-	MaxConns int    `json:"maxConns"`
+	ID              int                       `json:"id"`
+	Title           string                    `json:"title"`
+	MaxConns        int                       `json:"maxConns"`
+	KeyPressProfile int                       `json:"keyPressProfile,omitempty"`
+	Generator       *endpoint.GeneratorConfig `json:"generator,omitempty"`
+}
+
+// DiscoveredEndpoint is an endpoint's config plus, when available, its live status.
+type DiscoveredEndpoint struct {
+	DiscoverableEndpoint
+	Status *endpoint.EndpointStatus `json:"status,omitempty"`
 }
 
 type ManagerOption func(*RestManager)
@@ -35,19 +62,97 @@ func WithConfig(config []DiscoverableEndpoint) ManagerOption {
 	}
 }
 
-func WithLogger(l *log.Logger) ManagerOption {
+func WithEventChannel(eventChan chan<- event.Event) ManagerOption {
+	return func(m *RestManager) {
+		m.eventChan = eventChan
+	}
+}
+
+func WithStatusProvider(status StatusProvider) ManagerOption {
+	return func(m *RestManager) {
+		m.status = status
+	}
+}
+
+func WithScenarioController(scenario ScenarioController) ManagerOption {
+	return func(m *RestManager) {
+		m.scenario = scenario
+	}
+}
+
+func WithKeyboardController(keyboard KeyboardController) ManagerOption {
+	return func(m *RestManager) {
+		m.keyboard = keyboard
+	}
+}
+
+func WithReplayer(replayer Replayer) ManagerOption {
+	return func(m *RestManager) {
+		m.replayer = replayer
+	}
+}
+
+// WithHealthChecks are the subsystems reported on by HealthHandler and ReadinessHandler.
+func WithHealthChecks(subsystems ...health.Subsystem) ManagerOption {
+	return func(m *RestManager) {
+		m.health = subsystems
+	}
+}
+
+func WithLogger(l logging.Logger) ManagerOption {
 	return func(m *RestManager) {
 		m.logger = l
 	}
 }
 
+// SetConfig replaces the endpoints from WithConfig, e.g. after a config reload.
+func (m *RestManager) SetConfig(config []DiscoverableEndpoint) {
+	m.configLock.Lock()
+	defer m.configLock.Unlock()
+	m.config = config
+}
+
 func (m *RestManager) EndpointDiscoveryHandler(w http.ResponseWriter, r *http.Request) {
-	m.buildResponse(w, m.config)
+	m.configLock.RLock()
+	config := m.config
+	m.configLock.RUnlock()
+
+	discovered := make([]DiscoveredEndpoint, len(config))
+	for i, ep := range config {
+		discovered[i] = DiscoveredEndpoint{DiscoverableEndpoint: ep, Status: m.endpointStatus(ep.ID)}
+	}
+	m.buildResponse(w, discovered)
 	return
 }
 
-func (m *RestManager) buildErrorResponse(w http.ResponseWriter, err error) {
-	w.WriteHeader(http.StatusInternalServerError)
+func (m *RestManager) EndpointStateHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		m.buildErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	status := m.endpointStatus(id)
+	if status == nil {
+		m.buildErrorResponse(w, http.StatusNotFound, fmt.Errorf("endpoint %d: %w", id, event.ErrUnknownDestination))
+		return
+	}
+	m.buildResponse(w, status)
+}
+
+func (m *RestManager) endpointStatus(id int) *endpoint.EndpointStatus {
+	if m.status == nil {
+		return nil
+	}
+	if status, ok := m.status.EndpointStatus(id); ok {
+		return &status
+	}
+	return nil
+}
+
+func (m *RestManager) buildErrorResponse(w http.ResponseWriter, status int, err error) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
 	m.buildResponse(w, struct {
 		Error string `json:"error"`
 	}{err.Error()})
@@ -58,8 +163,7 @@ func (m *RestManager) buildResponse(w http.ResponseWriter, payload interface{})
 	w.Header().Add("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	if payload != nil {
-		prettyJSON, _ := json.MarshalIndent(payload, "", "    ")
-		m.logger.Printf("\nSending discovery response %s!", prettyJSON)
+		m.logger.Debug("Sending REST response", logging.Message, payload)
 		json.NewEncoder(w).Encode(payload)
 	}
 }
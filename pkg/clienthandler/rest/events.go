@@ -0,0 +1,71 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"endpoint-visualiser-server/pkg/event"
+	"endpoint-visualiser-server/pkg/logging"
+
+	"github.com/gorilla/mux"
+)
+
+type EventResponse struct {
+	Destination int    `json:"id"`
+	Event       string `json:"event"`
+}
+
+// EventHandler injects an event into the endpoint manager exactly as a keypress would,
+// then waits for the endpoint to say whether it accepted it.
+func (m *RestManager) EventHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		m.buildErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	e, err := event.Lookup(mux.Vars(r)["eventName"])
+	if err != nil {
+		m.buildErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = m.injectEvent(r, event.Event{Destination: id, Event: e})
+	switch {
+	case err == nil:
+		m.buildResponse(w, EventResponse{Destination: id, Event: e.String()})
+	case errors.Is(err, event.ErrUnknownDestination):
+		m.buildErrorResponse(w, http.StatusNotFound, fmt.Errorf("endpoint %d: %w", id, err))
+	case errors.Is(err, event.ErrUnknownEvent):
+		m.buildErrorResponse(w, http.StatusBadRequest, err)
+	case errors.Is(err, event.ErrRejected):
+		m.buildErrorResponse(w, http.StatusConflict, fmt.Errorf("%s on endpoint %d: %w", e, id, err))
+	default:
+		m.buildErrorResponse(w, http.StatusServiceUnavailable, err)
+	}
+}
+
+func (m *RestManager) injectEvent(r *http.Request, e event.Event) error {
+	if m.eventChan == nil {
+		return errors.New("event injection is not enabled")
+	}
+
+	result := make(chan error, 1)
+	e.Result = result
+	m.logger.Info("REST request injecting event", logging.EndpointID, e.Destination, logging.Event, e.String(), logging.ClientAddr, r.RemoteAddr)
+
+	select {
+	case m.eventChan <- e:
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+}
@@ -0,0 +1,27 @@
+package rest
+
+import (
+	"net/http"
+
+	"endpoint-visualiser-server/pkg/health"
+)
+
+// HealthHandler reports whether each subsystem is alive, with 503 Service Unavailable if any isn't.
+func (m *RestManager) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	m.buildHealthResponse(w, health.Liveness(m.health))
+}
+
+// ReadinessHandler reports whether each subsystem is ready to serve, with 503 Service
+// Unavailable if any isn't.
+func (m *RestManager) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	m.buildHealthResponse(w, health.Readiness(m.health))
+}
+
+func (m *RestManager) buildHealthResponse(w http.ResponseWriter, report health.Report) {
+	w.Header().Set("Cache-Control", "no-store")
+	if !report.OK {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	m.buildResponse(w, report)
+}
@@ -0,0 +1,90 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"endpoint-visualiser-server/pkg/keyboard"
+
+	"github.com/gorilla/mux"
+)
+
+// KeyboardController remaps which endpoints a keypress profile drives. *keyboard.Listener is the real one.
+type KeyboardController interface {
+	Attachments() map[int][]int
+	Attach(profile int, endpoints []int) error
+}
+
+// KeyPressProfileAttachment lists the endpoints a keypress profile's keys control.
+type KeyPressProfileAttachment struct {
+	Profile   int   `json:"keyPressProfile"`
+	Endpoints []int `json:"endpoints"`
+}
+
+func (m *RestManager) KeyPressProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	if m.keyboard == nil {
+		m.buildErrorResponse(w, http.StatusNotFound, errors.New("keyboard control is not enabled"))
+		return
+	}
+	m.buildResponse(w, attachmentList(m.keyboard.Attachments()))
+}
+
+// KeyPressProfileAttachHandler replaces the endpoints a profile controls with the JSON array of
+// endpoint IDs in the request body.
+func (m *RestManager) KeyPressProfileAttachHandler(w http.ResponseWriter, r *http.Request) {
+	if m.keyboard == nil {
+		m.buildErrorResponse(w, http.StatusNotFound, errors.New("keyboard control is not enabled"))
+		return
+	}
+
+	profile, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		m.buildErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	var endpoints []int
+	if err := json.NewDecoder(r.Body).Decode(&endpoints); err != nil {
+		m.buildErrorResponse(w, http.StatusBadRequest, fmt.Errorf("expected a JSON array of endpoint IDs: %w", err))
+		return
+	}
+	for _, id := range endpoints {
+		if !m.hasEndpoint(id) {
+			m.buildErrorResponse(w, http.StatusNotFound, fmt.Errorf("no endpoint has id %d", id))
+			return
+		}
+	}
+
+	err = m.keyboard.Attach(profile, endpoints)
+	switch {
+	case err == nil:
+		m.buildResponse(w, KeyPressProfileAttachment{Profile: profile, Endpoints: m.keyboard.Attachments()[profile]})
+	case errors.Is(err, keyboard.ErrUnknownProfile):
+		m.buildErrorResponse(w, http.StatusNotFound, err)
+	default:
+		m.buildErrorResponse(w, http.StatusInternalServerError, err)
+	}
+}
+
+func (m *RestManager) hasEndpoint(id int) bool {
+	m.configLock.RLock()
+	defer m.configLock.RUnlock()
+	for _, ep := range m.config {
+		if ep.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func attachmentList(attachments map[int][]int) []KeyPressProfileAttachment {
+	list := make([]KeyPressProfileAttachment, 0, len(attachments))
+	for profile, endpoints := range attachments {
+		list = append(list, KeyPressProfileAttachment{Profile: profile, Endpoints: endpoints})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Profile < list[j].Profile })
+	return list
+}
@@ -0,0 +1,48 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+
+	"endpoint-visualiser-server/pkg/scenario"
+)
+
+// Replayer plays a recorded session back. *replay.Player is the real one.
+type Replayer interface {
+	Replay(recording string, speed float64) (scenario.Status, error)
+}
+
+// ReplayRequest names a journal file and how much faster than the original to play it.
+type ReplayRequest struct {
+	Recording string  `json:"recording"`
+	Speed     float64 `json:"speed,omitempty"` // Defaults to 1, the original timing, the only one supported.
+}
+
+// ReplayHandler replays the recording named in the request body, replacing any scenario.
+func (m *RestManager) ReplayHandler(w http.ResponseWriter, r *http.Request) {
+	if m.replayer == nil {
+		m.buildErrorResponse(w, http.StatusNotFound, errors.New("replay is not enabled"))
+		return
+	}
+
+	request := ReplayRequest{Speed: 1}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		m.buildErrorResponse(w, http.StatusBadRequest, fmt.Errorf("expected {\"recording\": ..., \"speed\": ...}: %w", err))
+		return
+	}
+
+	status, err := m.replayer.Replay(request.Recording, request.Speed)
+	switch {
+	case err == nil:
+		m.buildResponse(w, status)
+	case errors.Is(err, fs.ErrNotExist):
+		m.buildErrorResponse(w, http.StatusNotFound, errors.New("no such recording "+request.Recording))
+	case errors.Is(err, scenario.ErrAlreadyRunning):
+		m.buildErrorResponse(w, http.StatusConflict, err)
+	default:
+		m.buildErrorResponse(w, http.StatusBadRequest, err)
+	}
+}
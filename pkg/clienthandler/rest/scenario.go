@@ -0,0 +1,56 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+
+	"endpoint-visualiser-server/pkg/scenario"
+
+	"github.com/gorilla/mux"
+)
+
+// ScenarioController drives a scenario. *scenario.Runner is the real one.
+type ScenarioController interface {
+	Start() error
+	Pause() error
+	Stop() error
+	Status() scenario.Status
+}
+
+func (m *RestManager) ScenarioStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if m.scenario == nil {
+		m.buildErrorResponse(w, http.StatusNotFound, scenario.ErrNoScenario)
+		return
+	}
+	m.buildResponse(w, m.scenario.Status())
+}
+
+// ScenarioControlHandler starts, pauses or stops the scenario, as named by the "action" route variable.
+func (m *RestManager) ScenarioControlHandler(w http.ResponseWriter, r *http.Request) {
+	if m.scenario == nil {
+		m.buildErrorResponse(w, http.StatusNotFound, scenario.ErrNoScenario)
+		return
+	}
+
+	var err error
+	switch action := mux.Vars(r)["action"]; action {
+	case "start":
+		err = m.scenario.Start()
+	case "pause":
+		err = m.scenario.Pause()
+	case "stop":
+		err = m.scenario.Stop()
+	default:
+		m.buildErrorResponse(w, http.StatusBadRequest, errors.New("unknown scenario action "+action))
+		return
+	}
+
+	switch {
+	case err == nil:
+		m.buildResponse(w, m.scenario.Status())
+	case errors.Is(err, scenario.ErrNoScenario):
+		m.buildErrorResponse(w, http.StatusNotFound, err)
+	default:
+		m.buildErrorResponse(w, http.StatusConflict, err)
+	}
+}
@@ -0,0 +1,92 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+
+	"endpoint-visualiser-server/pkg/logging"
+	"endpoint-visualiser-server/pkg/metrics"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultPongWait     = 60 * time.Second
+	defaultPingInterval = (defaultPongWait * 9) / 10
+	writeWait           = 10 * time.Second
+	maxInboundBytes     = 4096
+)
+
+// client is a single subscriber's connection. Gorilla connections only support one
+// concurrent writer, so each gets its own lock.
+type client struct {
+	conn      *websocket.Conn
+	addr      string
+	writeLock sync.Mutex
+	done      chan struct{} // closed once the client has been deregistered
+	closeOnce sync.Once
+}
+
+func newClient(conn *websocket.Conn) *client {
+	return &client{conn: conn, addr: conn.RemoteAddr().String(), done: make(chan struct{})}
+}
+
+func (c *client) write(bytes []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(websocket.TextMessage, bytes)
+}
+
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// readPump owns all reads from the connection. It keeps the read deadline alive on every pong,
+// and deregisters the client as soon as the connection dies or the browser closes it.
+func (m *Manager) readPump(id int, c *client) {
+	defer m.removeClient(id, c)
+
+	c.conn.SetReadLimit(maxInboundBytes)
+	c.conn.SetReadDeadline(time.Now().Add(m.pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(m.pongWait))
+	})
+
+	for {
+		_, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				m.logger.Info("Client closed the connection", logging.EndpointID, id, logging.ClientAddr, c.addr)
+			} else {
+				m.logger.Warn("Lost client", logging.EndpointID, id, logging.ClientAddr, c.addr, logging.Err, err)
+			}
+			return
+		}
+		m.handleInbound(id, c, msg)
+	}
+}
+
+// pingPump pings the client until it's deregistered. A client that stops answering
+// will miss its read deadline, and the read pump takes care of the rest.
+func (m *Manager) pingPump(id int, c *client) {
+	ticker := time.NewTicker(m.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				m.logger.Warn("Failed to ping client", logging.EndpointID, id, logging.ClientAddr, c.addr, logging.Err, err)
+				m.metrics.WriteErrors.Inc(metrics.Endpoint(id))
+				m.removeClient(id, c)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
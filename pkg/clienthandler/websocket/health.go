@@ -0,0 +1,30 @@
+package websocket
+
+import (
+	"fmt"
+
+	"endpoint-visualiser-server/pkg/health"
+)
+
+// Live is always true, registrations are handled on the HTTP server's goroutines.
+func (m *Manager) Live() health.Status {
+	return health.Up(fmt.Sprintf("%d clients registered", m.clientCount()))
+}
+
+// Ready is false once Close has been called, as new clients are turned away.
+func (m *Manager) Ready() health.Status {
+	if m.isClosed() {
+		return health.Down(errShuttingDown.Error())
+	}
+	return m.Live()
+}
+
+func (m *Manager) clientCount() int {
+	m.clientLock.RLock()
+	defer m.clientLock.RUnlock()
+	count := 0
+	for _, clients := range m.clients {
+		count += len(clients)
+	}
+	return count
+}
@@ -0,0 +1,84 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"endpoint-visualiser-server/pkg/event"
+	"endpoint-visualiser-server/pkg/logging"
+	"endpoint-visualiser-server/pkg/metrics"
+)
+
+const inboundEventType = "event"
+
+// InboundMessage is what a browser may send on its registration socket, e.g.
+// {"type":"event","event":"DelayLongEvent"} to act on the endpoint it's watching.
+type InboundMessage struct {
+	Type  string `json:"type"`
+	Event string `json:"event"`
+}
+
+// EventResultMessage tells the sending client (only) whether its event was accepted.
+type EventResultMessage struct {
+	ID       string `json:"id"`
+	Event    string `json:"event"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+const eventResultMessageID = "EventResult"
+
+func (m *Manager) handleInbound(id int, c *client, raw []byte) {
+	var msg InboundMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		m.replyToClient(id, c, EventResultMessage{ID: eventResultMessageID, Error: fmt.Sprintf("malformed message: %s", err.Error())})
+		return
+	}
+	if msg.Type != inboundEventType {
+		m.replyToClient(id, c, EventResultMessage{ID: eventResultMessageID, Event: msg.Event, Error: fmt.Sprintf("unknown message type %q", msg.Type)})
+		return
+	}
+	if m.eventChan == nil {
+		m.replyToClient(id, c, EventResultMessage{ID: eventResultMessageID, Event: msg.Event, Error: "events from clients are not enabled"})
+		return
+	}
+
+	e, err := event.Lookup(msg.Event)
+	if err != nil {
+		m.replyToClient(id, c, EventResultMessage{ID: eventResultMessageID, Event: msg.Event, Error: err.Error()})
+		return
+	}
+
+	m.logger.Info("Client sent event", logging.EndpointID, id, logging.ClientAddr, c.addr, logging.Event, e.String())
+	result := make(chan error, 1)
+	select {
+	case m.eventChan <- event.Event{Destination: id, Event: e, Result: result}:
+	case <-c.done:
+		return
+	}
+
+	// Don't hold up the read pump while the endpoint processes the event.
+	go func() {
+		select {
+		case err := <-result:
+			reply := EventResultMessage{ID: eventResultMessageID, Event: e.String(), Accepted: err == nil}
+			if err != nil {
+				reply.Error = err.Error()
+			}
+			m.replyToClient(id, c, reply)
+		case <-c.done:
+		}
+	}()
+}
+
+func (m *Manager) replyToClient(id int, c *client, reply EventResultMessage) {
+	bytes, err := json.Marshal(reply)
+	if err == nil {
+		err = c.write(bytes)
+	}
+	if err != nil {
+		m.logger.Warn("Couldn't reply to client, cutting them off", logging.EndpointID, id, logging.ClientAddr, c.addr, logging.Err, err)
+		m.metrics.WriteErrors.Inc(metrics.Endpoint(id))
+		m.removeClient(id, c)
+	}
+}
@@ -2,6 +2,7 @@ package websocket
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 
@@ -13,18 +14,39 @@ func GetMockWithClientRegisterer(t *testing.T, numEndpoints int) func(*Manager)
 		// Dont need to register anything.
 		m.registrationHandler = func(w http.ResponseWriter, r *http.Request) { return }
 
+		server := newMockWSServer(t)
 		for i := 0; i < numEndpoints; i++ {
-			m.clientLock.Lock()
-			m.clients[i] = generateMockWSClient(t)
-			m.clientLock.Unlock()
+			m.addClient(i, newClient(generateMockWSClient(t, server)))
 		}
 		return
 	}
 
 }
 
-func generateMockWSClient(t *testing.T) *websocket.Conn {
-	mockURL := url.URL{Scheme: "ws", Host: "localhost:8080", Path: "/echo"}
+// newMockWSServer accepts websocket connections and discards anything written to them.
+func newMockWSServer(t *testing.T) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func generateMockWSClient(t *testing.T, server *httptest.Server) *websocket.Conn {
+	serverURL, _ := url.Parse(server.URL)
+	mockURL := url.URL{Scheme: "ws", Host: serverURL.Host, Path: "/echo"}
 	mockClient, _, err := websocket.DefaultDialer.Dial(mockURL.String(), nil)
 	if err != nil {
 		t.Fail()
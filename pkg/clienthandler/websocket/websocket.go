@@ -2,12 +2,16 @@ package websocket
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"strconv"
 	"sync"
+	"time"
+
+	"endpoint-visualiser-server/pkg/event"
+	"endpoint-visualiser-server/pkg/logging"
+	"endpoint-visualiser-server/pkg/metrics"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -16,18 +20,47 @@ import (
 type Manager struct {
 	registrationHandler func(w http.ResponseWriter, r *http.Request)
 	clientLock          sync.RWMutex
-	clients             map[int]*websocket.Conn
-	logger              *log.Logger
+	clients             map[int]map[*client]struct{} // Every subscriber, by endpoint ID.
+	subscriberHook      func(id int, subscribers int)
+	eventChan           chan<- event.Event
+	pingInterval        time.Duration
+	pongWait            time.Duration
+	closed              bool
+	logger              logging.Logger
+	metrics             *metrics.Metrics
 }
 
 type ManagerOption func(*Manager)
 
-func WithLogger(l *log.Logger) ManagerOption {
+func WithLogger(l logging.Logger) ManagerOption {
 	return func(m *Manager) {
 		m.logger = l
 	}
 }
 
+// WithMetrics records subscriber counts and write errors, see metrics.Metrics.
+func WithMetrics(mx *metrics.Metrics) ManagerOption {
+	return func(m *Manager) {
+		m.metrics = mx
+	}
+}
+
+// WithEventChannel lets clients send control events for the endpoint they're registered on.
+func WithEventChannel(eventChan chan<- event.Event) ManagerOption {
+	return func(m *Manager) {
+		m.eventChan = eventChan
+	}
+}
+
+// WithKeepalive sets how often clients are pinged, and how long to wait for a pong
+// before giving up on them. pingInterval should be comfortably shorter than pongWait.
+func WithKeepalive(pingInterval, pongWait time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.pingInterval = pingInterval
+		m.pongWait = pongWait
+	}
+}
+
 func WithClientRegisterer(m *Manager) {
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
@@ -42,18 +75,21 @@ func WithClientRegisterer(m *Manager) {
 			return
 		}
 
-		m.logger.Printf("\nReceived Registration Request for endpoint %d!", id)
+		m.logger.Info("Registration request", logging.EndpointID, id, logging.ClientAddr, r.RemoteAddr)
+		if m.isClosed() {
+			m.buildErrorResponse(w, errShuttingDown)
+			return
+		}
 		websocket, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			m.buildErrorResponse(w, err)
 			return
 		}
 
-		m.clientLock.Lock()
-		m.clients[id] = websocket
-		m.clientLock.Unlock()
-
-		m.buildResponse(w, nil)
+		c := newClient(websocket)
+		m.addClient(id, c)
+		go m.readPump(id, c)
+		go m.pingPump(id, c)
 	}
 }
 
@@ -69,15 +105,19 @@ func (m *Manager) buildResponse(w http.ResponseWriter, payload interface{}) {
 	w.Header().Add("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	if payload != nil {
-		prettyJSON, _ := json.MarshalIndent(payload, "", "    ")
-		m.logger.Printf("Sending %s", prettyJSON)
+		m.logger.Debug("Sending registration response", logging.Message, payload)
 		json.NewEncoder(w).Encode(payload)
 	}
 }
 
 func New(opts ...ManagerOption) *Manager {
-	defaultDiscardLogger := log.New(ioutil.Discard, "", 0)
-	manager := &Manager{clients: make(map[int]*websocket.Conn), logger: defaultDiscardLogger}
+	manager := &Manager{
+		clients:      make(map[int]map[*client]struct{}),
+		pingInterval: defaultPingInterval,
+		pongWait:     defaultPongWait,
+		logger:       logging.Discard(),
+		metrics:      metrics.New(),
+	}
 	for _, opt := range opts {
 		opt(manager)
 	}
@@ -88,27 +128,153 @@ func (m *Manager) Handler() func(w http.ResponseWriter, r *http.Request) {
 	return m.registrationHandler
 }
 
+// GetSingleRequestSender returns a sender that broadcasts to every subscriber of endpoint id.
 func (m *Manager) GetSingleRequestSender(id int) func(interface{}) error {
 	return func(event interface{}) error {
-		return m.sendRequestToSingleClient(id, event)
+		return m.sendRequestToEndpointClients(id, event)
+	}
+}
+
+// Broadcast sends event to every registered client, whichever endpoint they're watching.
+// Clients whose write fails are cut off, as with an endpoint's sender.
+func (m *Manager) Broadcast(event interface{}) error {
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	m.clientLock.RLock()
+	everyone := make(map[*client]int)
+	for id, clients := range m.clients {
+		for c := range clients {
+			everyone[c] = id
+		}
+	}
+	m.clientLock.RUnlock()
+
+	for c, id := range everyone {
+		if err := c.write(bytes); err != nil {
+			m.logger.Warn("Couldn't write to client, cutting them off", logging.EndpointID, id, logging.ClientAddr, c.addr, logging.Err, err)
+			m.metrics.WriteErrors.Inc(metrics.Endpoint(id))
+			m.removeClient(id, c)
+		}
+	}
+	return nil
+}
+
+var errShuttingDown = errors.New("server is shutting down")
+
+func (m *Manager) isClosed() bool {
+	m.clientLock.RLock()
+	defer m.clientLock.RUnlock()
+	return m.closed
+}
+
+// Close sends every client a close frame and deregisters them. No new clients can register afterwards.
+func (m *Manager) Close() {
+	m.clientLock.Lock()
+	m.closed = true
+	everyone := make(map[*client]int)
+	for id, clients := range m.clients {
+		for c := range clients {
+			everyone[c] = id
+		}
+	}
+	m.clientLock.Unlock()
+
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, errShuttingDown.Error())
+	for c, id := range everyone {
+		if err := c.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(writeWait)); err != nil {
+			m.logger.Warn("Error closing client", logging.EndpointID, id, logging.ClientAddr, c.addr, logging.Err, err)
+		}
+		m.removeClient(id, c)
 	}
 }
 
-func (m *Manager) sendRequestToSingleClient(id int, event interface{}) error {
+// OnSubscribersChanged registers a hook called with an endpoint's new subscriber count
+// whenever a client registers or is deregistered, e.g. so the endpoint manager knows when
+// nobody is watching.
+func (m *Manager) OnSubscribersChanged(hook func(id int, subscribers int)) {
+	m.clientLock.Lock()
+	defer m.clientLock.Unlock()
+	m.subscriberHook = hook
+}
 
+func (m *Manager) addClient(id int, c *client) {
+	m.clientLock.Lock()
 	if m.clients[id] == nil {
+		m.clients[id] = make(map[*client]struct{})
+	}
+	m.clients[id][c] = struct{}{}
+	subscribers, hook := len(m.clients[id]), m.subscriberHook
+	m.clientLock.Unlock()
+
+	m.logger.Info("Subscribers changed", logging.EndpointID, id, logging.Subscribers, subscribers)
+	m.metrics.Subscribers.Set(float64(subscribers), metrics.Endpoint(id))
+	if hook != nil {
+		hook(id, subscribers)
+	}
+}
+
+// removeClient deregisters and closes a client. It's safe to call more than once.
+func (m *Manager) removeClient(id int, c *client) {
+	m.clientLock.Lock()
+	if _, ok := m.clients[id][c]; !ok {
+		m.clientLock.Unlock()
+		return
+	}
+	delete(m.clients[id], c)
+	if len(m.clients[id]) == 0 {
+		delete(m.clients, id)
+	}
+	subscribers, hook := len(m.clients[id]), m.subscriberHook
+	m.clientLock.Unlock()
+
+	c.close()
+	m.logger.Info("Subscribers changed", logging.EndpointID, id, logging.Subscribers, subscribers)
+	m.metrics.Subscribers.Set(float64(subscribers), metrics.Endpoint(id))
+	if hook != nil {
+		hook(id, subscribers)
+	}
+}
+
+func (m *Manager) endpointClients(id int) []*client {
+	m.clientLock.RLock()
+	defer m.clientLock.RUnlock()
+	clients := make([]*client, 0, len(m.clients[id]))
+	for c := range m.clients[id] {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// sendRequestToEndpointClients only fails if nobody at all received the event. A subscriber
+// whose write fails is cut off without affecting anyone else.
+func (m *Manager) sendRequestToEndpointClients(id int, event interface{}) error {
+
+	clients := m.endpointClients(id)
+	if len(clients) == 0 {
 		return fmt.Errorf("No client has registered to receive websocket events for endpoint %d", id)
 	}
 
 	bytes, err := json.Marshal(event)
-	if err == nil {
-		m.clientLock.Lock()
-		defer m.clientLock.Unlock()
-		err = m.clients[id].WriteMessage(websocket.TextMessage, bytes)
-		if err != nil {
-			err = fmt.Errorf("Error writing to client %d, cutting them all off! Error detail: %s", id, err.Error())
-			m.clients = make(map[int]*websocket.Conn)
+	if err != nil {
+		return err
+	}
+
+	delivered := 0
+	for _, c := range clients {
+		if err = c.write(bytes); err != nil {
+			m.logger.Warn("Couldn't write to client, cutting them off", logging.EndpointID, id, logging.ClientAddr, c.addr, logging.Err, err)
+			m.metrics.WriteErrors.Inc(metrics.Endpoint(id))
+			m.removeClient(id, c)
+			continue
 		}
+		delivered++
+	}
+
+	if delivered == 0 {
+		return fmt.Errorf("Every client of endpoint %d failed, last error: %s", id, err.Error())
 	}
-	return err
+	return nil
 }
@@ -0,0 +1,158 @@
+package websocket_test
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"endpoint-visualiser-server/pkg/clienthandler/websocket"
+	"endpoint-visualiser-server/pkg/event"
+
+	"github.com/gorilla/mux"
+	gorilla "github.com/gorilla/websocket"
+)
+
+func TestFanOutToEverySubscriber(t *testing.T) {
+
+	manager := websocket.New(websocket.WithClientRegisterer)
+	router := mux.NewRouter()
+	router.Path("/websocketRegistration/{id:[0-9]+}").HandlerFunc(manager.Handler())
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	presenter := subscribe(t, server, 1)
+	laptop := subscribe(t, server, 1)
+	other := subscribe(t, server, 2)
+
+	send := manager.GetSingleRequestSender(1)
+	if err := send(map[string]string{"id": "EndpointConnected"}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	expectMessage(t, presenter, "EndpointConnected")
+	expectMessage(t, laptop, "EndpointConnected")
+	expectNoMessage(t, other)
+
+	// Losing the presenter must only cut off the presenter.
+	presenter.Close()
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = send(map[string]string{"id": "TrafficRequest"})
+		expectMessage(t, laptop, "TrafficRequest")
+	}
+	if err != nil {
+		t.Fatalf("send failed with a subscriber still connected: %s", err)
+	}
+
+	laptop.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for err == nil && time.Now().Before(deadline) {
+		err = send(map[string]string{"id": "TrafficRequest"})
+	}
+	if err == nil {
+		t.Fatalf("expected an error once every subscriber has gone")
+	}
+}
+
+func subscribe(t *testing.T, server *httptest.Server, id int) *gorilla.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/websocketRegistration/" + strconv.Itoa(id)
+	conn, _, err := gorilla.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("couldn't subscribe to endpoint %d: %s", id, err)
+	}
+	// Registration completes after the upgrade, give it a moment.
+	time.Sleep(50 * time.Millisecond)
+	return conn
+}
+
+func expectMessage(t *testing.T, conn *gorilla.Conn, want string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("expected %s, got error: %s", want, err)
+	}
+	if !strings.Contains(string(msg), want) {
+		t.Fatalf("expected %s, got %s", want, msg)
+	}
+}
+
+func expectNoMessage(t *testing.T, conn *gorilla.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, msg, err := conn.ReadMessage(); err == nil {
+		t.Fatalf("unexpected message %s", msg)
+	}
+}
+
+func TestDeadSubscribersAreDeregistered(t *testing.T) {
+
+	manager := websocket.New(
+		websocket.WithClientRegisterer,
+		websocket.WithKeepalive(50*time.Millisecond, 200*time.Millisecond),
+	)
+	counts := make(chan int, 16)
+	manager.OnSubscribersChanged(func(id int, subscribers int) { counts <- subscribers })
+
+	router := mux.NewRouter()
+	router.Path("/websocketRegistration/{id:[0-9]+}").HandlerFunc(manager.Handler())
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// A browser closing politely is noticed without us having to write to it.
+	closer := subscribe(t, server, 1)
+	expectCount(t, counts, 1)
+	closer.WriteMessage(gorilla.CloseMessage, gorilla.FormatCloseMessage(gorilla.CloseNormalClosure, ""))
+	expectCount(t, counts, 0)
+
+	// One that never reads never answers our pings, so should time out.
+	silent := subscribe(t, server, 1)
+	defer silent.Close()
+	expectCount(t, counts, 1)
+	expectCount(t, counts, 0)
+}
+
+func expectCount(t *testing.T, counts <-chan int, want int) {
+	t.Helper()
+	select {
+	case got := <-counts:
+		if got != want {
+			t.Fatalf("expected %d subscribers, got %d", want, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected %d subscribers, hook never called", want)
+	}
+}
+
+func TestClientsCanSendEvents(t *testing.T) {
+
+	eventChan := make(chan event.Event)
+	manager := websocket.New(
+		websocket.WithClientRegisterer,
+		websocket.WithEventChannel(eventChan),
+	)
+	router := mux.NewRouter()
+	router.Path("/websocketRegistration/{id:[0-9]+}").HandlerFunc(manager.Handler())
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	conn := subscribe(t, server, 3)
+	defer conn.Close()
+
+	conn.WriteJSON(websocket.InboundMessage{Type: "event", Event: "DelayLongEvent"})
+	select {
+	case e := <-eventChan:
+		if e.Destination != 3 || e.String() != "DelayLongEvent" {
+			t.Fatalf("unexpected event %s for endpoint %d", e, e.Destination)
+		}
+		e.Reply(event.ErrRejected)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("event never reached the event channel")
+	}
+	expectMessage(t, conn, `"accepted":false`)
+
+	conn.WriteJSON(websocket.InboundMessage{Type: "event", Event: "NotAnEvent"})
+	expectMessage(t, conn, "unknown event")
+}
@@ -0,0 +1,121 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake only moves when told to. Timers fire, in deadline order, as Advance passes them.
+type Fake struct {
+	lock    sync.Mutex
+	changed *sync.Cond // Broadcast whenever the set of pending timers changes.
+	now     time.Time
+	timers  []*fakeTimer // Pending, i.e. started and not yet fired or stopped.
+}
+
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.changed = sync.NewCond(&f.lock)
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+// NewTimer fires straight away if d isn't positive, as a real timer would as soon as it could.
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: f, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock on by d, firing every timer that falls due on the way.
+func (f *Fake) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	end := f.now.Add(d)
+	for {
+		sort.SliceStable(f.timers, func(i, j int) bool { return f.timers[i].deadline.Before(f.timers[j].deadline) })
+		if len(f.timers) == 0 || f.timers[0].deadline.After(end) {
+			break
+		}
+		next := f.timers[0]
+		f.now = next.deadline
+		f.fire(next)
+	}
+	f.now = end
+}
+
+// BlockUntil waits until n timers are pending, so a test knows the code under test has got as
+// far as waiting before it calls Advance.
+func (f *Fake) BlockUntil(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for len(f.timers) != n {
+		f.changed.Wait()
+	}
+}
+
+// Pending is how many timers are waiting to fire.
+func (f *Fake) Pending() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.timers)
+}
+
+// fire must be called with lock held. Like a real timer, it drops the tick if the last one
+// hasn't been received.
+func (f *Fake) fire(t *fakeTimer) {
+	f.remove(t)
+	select {
+	case t.c <- f.now:
+	default:
+	}
+}
+
+// remove must be called with lock held. It reports whether t was pending.
+func (f *Fake) remove(t *fakeTimer) bool {
+	for i, pending := range f.timers {
+		if pending == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			f.changed.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	clock    *Fake
+	c        chan time.Time
+	deadline time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	return t.clock.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	f := t.clock
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	wasPending := f.remove(t)
+	t.deadline = f.now.Add(d)
+	if d <= 0 {
+		f.fire(t)
+		return wasPending
+	}
+	f.timers = append(f.timers, t)
+	f.changed.Broadcast()
+	return wasPending
+}
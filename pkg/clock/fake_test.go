@@ -0,0 +1,56 @@
+package clock_test
+
+import (
+	"testing"
+	"time"
+
+	"endpoint-visualiser-server/pkg/clock"
+)
+
+func TestFakeFiresTimersInDeadlineOrder(t *testing.T) {
+	start := time.Unix(0, 0)
+	c := clock.NewFake(start)
+	late, early := c.NewTimer(2*time.Second), c.NewTimer(time.Second)
+	stopped := c.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Fatal("Stop on a pending timer should report true")
+	}
+	c.BlockUntil(2)
+
+	c.Advance(999 * time.Millisecond)
+	select {
+	case <-early.C():
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	c.Advance(1001 * time.Millisecond)
+	if got := <-early.C(); !got.Equal(start.Add(time.Second)) {
+		t.Errorf("early fired at %v, want %v", got, start.Add(time.Second))
+	}
+	if got := <-late.C(); !got.Equal(start.Add(2 * time.Second)) {
+		t.Errorf("late fired at %v, want %v", got, start.Add(2*time.Second))
+	}
+	select {
+	case <-stopped.C():
+		t.Error("stopped timer fired")
+	default:
+	}
+	if c.Pending() != 0 {
+		t.Errorf("%d timers still pending", c.Pending())
+	}
+}
+
+func TestFakeFiresImmediateTimersStraightAway(t *testing.T) {
+	c := clock.NewFake(time.Unix(0, 0))
+	timer := c.NewTimer(0)
+	select {
+	case <-timer.C():
+	default:
+		t.Fatal("zero duration timer didn't fire")
+	}
+
+	timer.Reset(time.Minute)
+	c.Advance(time.Minute)
+	<-timer.C()
+}
@@ -2,6 +2,11 @@ package endpoint
 
 import (
 	"endpoint-visualiser-server/pkg/event"
+	"endpoint-visualiser-server/pkg/logging"
+	"endpoint-visualiser-server/pkg/metrics"
+	"fmt"
+	"math/rand"
+	"sync"
 )
 
 type ClientSender func(interface{}) error
@@ -17,33 +22,154 @@ const (
 
 type endpointProcessingState struct {
 	endpointState     epState
-	currentDelayState int
+	currentDelayState responseDelay
+	failures          FailureModes
+	targetTPS         float64
 }
 
-func (m *Manager) endpointProcessor(epConfig ManagableEndpoint, eventInChan <-chan interface{}) {
+func (s endpointProcessingState) behaviour() responseBehaviour {
+	return responseBehaviour{delay: s.currentDelayState, failures: s.failures, targetTPS: s.targetTPS}
+}
+
+func initialProcessingState() endpointProcessingState {
+	return endpointProcessingState{
+		endpointState:     epStateDown,
+		currentDelayState: fixedDelay(noResponseDelayMS),
+	}
+}
+
+// managedEndpoint is owned by a single endpointProcessor goroutine. Each endpoint gets its
+// own traffic control structures so events for one endpoint can never affect another.
+type managedEndpoint struct {
+	config ManagableEndpoint
+	sender ClientSender
+	cntl   *controlStructures // nil when no traffic or heartbeats are running
+	pool   *connectionPool    // nil while disconnected
+
+	// Each carries on from run to run, until the manager is reseeded. Only the current
+	// initiator uses them.
+	trafficRng   *rand.Rand
+	heartbeatRng *rand.Rand
+
+	requestSeq uint64 // Only used by the current traffic initiator.
+	tally      trafficTally
+	meter      rateMeter // Only used for stats.
+
+	inFlight sync.WaitGroup // Requests still waiting on their response.
+}
+
+func (m *Manager) endpointProcessor(epConfig ManagableEndpoint, seed int64, eventInChan <-chan interface{}) {
 
-	m.logger.Printf("\nEndpoint Processor %d started!", epConfig.ID)
+	m.logger.Info("Endpoint processor started", logging.EndpointID, epConfig.ID)
 
 	sender := m.websocketManager.GetSingleRequestSender(epConfig.ID)
-	state := endpointProcessingState{
-		endpointState:     epStateDown,
-		currentDelayState: noResponseDelayMS,
+	ep := &managedEndpoint{
+		config: epConfig,
+		sender: func(payload interface{}) error {
+			m.journal.RecordMessage(epConfig.ID, payload)
+			return sender(payload)
+		},
+		meter: rateMeter{since: m.clock.Now()},
 	}
+	m.seedEndpoint(ep, seed)
+	state := initialProcessingState()
 
+	reason := serverShutdownReason
 	for eRaw := range eventInChan {
-		m.logger.Printf("\nEndpoint Processor %d received message on inChan!", epConfig.ID)
+		switch update := eRaw.(type) {
+		case ManagableEndpoint:
+			m.logger.Info("Endpoint config updated", logging.EndpointID, epConfig.ID)
+			ep.config = update
+			continue
+		case endpointRemoved:
+			reason = endpointRemovedReason
+			continue
+		case statsTick:
+			m.sendStats(ep, state)
+			continue
+		case reseed:
+			m.seedEndpoint(ep, update.seed)
+			if stopTrafficEventPredicate(state) {
+				// Traffic is running, restart it from the new seed straight away.
+				m.startTraffic(ep, m.trafficGenerator(ep), state.behaviour())
+			}
+			continue
+		}
 		if e, ok := eRaw.(event.Event); ok {
-			var payload interface{}
-			payload, state = m.handlerMap[e.String()].handleEvent(state, sender)
+			m.metrics.EventsReceived.Inc(metrics.Endpoint(epConfig.ID), event.Kind(e.Event))
+			handler, ok := m.handlerFor(e.Event)
+			if !ok {
+				m.logger.Warn("No handler for event", logging.EndpointID, epConfig.ID, logging.Event, e.String())
+				e.Reply(fmt.Errorf("%w: %s", event.ErrUnknownEvent, e.String()))
+				continue
+			}
+			previous := state
+			payload, newState, err := handler.handleEvent(state, ep)
+			state = newState
+			if err != nil {
+				m.logger.Info("Event rejected", logging.EndpointID, epConfig.ID, logging.Event, e.String(), logging.StateFrom, previous.endpointState.String(), logging.Err, err)
+			} else {
+				m.logger.Info("Event handled", logging.EndpointID, epConfig.ID, logging.Event, e.String(), logging.StateFrom, previous.endpointState.String(), logging.StateTo, state.endpointState.String())
+			}
+			m.journal.RecordTransition(epConfig.ID, e.String(), previous.endpointState.String(), state.endpointState.String(), err)
+			m.publishStatus(epConfig.ID, state, ep.pool, e.String())
+			e.Reply(err)
 			if payload != nil {
-				m.logger.Printf("\n Sending message to client: %s", payload)
-				err := sender(payload)
-				if err != nil {
-					m.logger.Printf("\nError sending message to client: %s", err.Error())
+				m.logger.Debug("Sending message to clients", logging.EndpointID, epConfig.ID, logging.Message, payload)
+				if err := ep.sender(payload); err != nil {
+					m.logger.Warn("Couldn't send message to clients", logging.EndpointID, epConfig.ID, logging.Err, err)
 				}
 			}
 			continue
 		}
-		m.logger.Printf("\nType assert error on event received by endpoint %d", epConfig.ID)
+		m.logger.Error("Endpoint processor received something that isn't an event", logging.EndpointID, epConfig.ID, logging.Message, eRaw)
+	}
+	m.shutdownEndpoint(ep, reason)
+}
+
+// randStream separates an endpoint's random sequences, so however many heartbeats happen to go
+// out never changes its traffic.
+type randStream int64
+
+const (
+	trafficStream randStream = iota
+	heartbeatStream
+)
+
+// endpointRand gives each endpoint its own sequences from the manager's seed.
+func (m *Manager) endpointRand(seed int64, id int, stream randStream) *rand.Rand {
+	return rand.New(m.newSource(seed + int64(id) + int64(stream)<<32))
+}
+
+// seedEndpoint starts the endpoint's random sequences over from seed.
+func (m *Manager) seedEndpoint(ep *managedEndpoint, seed int64) {
+	ep.trafficRng = m.endpointRand(seed, ep.config.ID, trafficStream)
+	ep.heartbeatRng = m.endpointRand(seed, ep.config.ID, heartbeatStream)
+}
+
+// reseed is sent to every processor when the manager is reseeded.
+type reseed struct{ seed int64 }
+
+// endpointRemoved is sent to a processor just before its channel is closed, when its
+// endpoint has been taken out of config rather than the whole server shutting down.
+type endpointRemoved struct{}
+
+// shutdownEndpoint stops new traffic, lets in-flight requests finish, then tells the
+// endpoint's clients it's going away.
+func (m *Manager) shutdownEndpoint(ep *managedEndpoint, reason string) {
+	defer m.processors.Done()
+	m.logger.Info("Endpoint processor shutting down", logging.EndpointID, ep.config.ID, "reason", reason)
+
+	m.stopTraffic(ep)
+	m.closePool(ep) // Abandons responses still to come, and ones that were never going to come.
+	ep.inFlight.Wait()
+
+	if reason == endpointRemovedReason {
+		m.forgetStatus(ep.config.ID)
+	} else {
+		m.publishStatus(ep.config.ID, initialProcessingState(), nil, "")
+	}
+	if err := ep.sender(EndpointDisconnectedMessage{endpointDisconnected, reason}); err != nil {
+		m.logger.Warn("Couldn't send shutdown to clients", logging.EndpointID, ep.config.ID, logging.Err, err)
 	}
 }
@@ -1,11 +1,16 @@
 package endpoint_test
 
 import (
+	"context"
 	"endpoint-visualiser-server/pkg/clienthandler/websocket"
 	"endpoint-visualiser-server/pkg/endpoint"
 	"endpoint-visualiser-server/pkg/event"
+	"fmt"
 	"math/rand"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestEndpointProcessor(t *testing.T) {
@@ -58,3 +63,410 @@ func generateConfig(numEndpoints int, gens configGenerators) (config []endpoint.
 	}
 	return
 }
+
+func TestEndpointTrafficIsIndependent(t *testing.T) {
+
+	const numEndpoints = 4
+	eventChan := make(chan event.Event)
+	clients := newRecordingClients(numEndpoints)
+
+	manager := endpoint.NewManager(eventChan,
+		endpoint.WithConfig(generateConfig(numEndpoints, configGenerators{randomMaxConnsGenerator, randomCharStringGenerator})),
+		endpoint.WithWebSocketTarget(clients))
+	manager.Start(context.Background(), &sync.WaitGroup{})
+
+	// Impairing an endpoint before it connects must only impair that endpoint.
+	eventChan <- event.Event{Destination: 2, Event: event.StopRespondingEvent{}}
+	clients.expect(t, 2, isMessage(endpoint.EndpointImpairmentMessage{}))
+
+	for id := 0; id < numEndpoints; id++ {
+		eventChan <- event.Event{Destination: id, Event: event.ConnectEvent{}}
+		clients.expect(t, id, isMessage(endpoint.EndpointConnectedMessage{}))
+		clients.expect(t, id, isTraffic("TrafficRequest"))
+	}
+
+	// Disconnecting one endpoint must leave everyone else's heartbeat running.
+	eventChan <- event.Event{Destination: 1, Event: event.DisconnectEvent{}}
+	clients.expect(t, 1, isMessage(endpoint.EndpointDisconnectedMessage{}))
+
+	for _, id := range []int{0, 3} {
+		clients.expect(t, id, isTraffic("TrafficResponse"))
+		clients.expect(t, id, isTraffic("TrafficRequest"))
+		clients.expect(t, id, isTraffic("TrafficResponse"))
+	}
+	clients.expectNone(t, 2, isTraffic("TrafficResponse"), responseWait)
+	clients.expectNone(t, 1, isTraffic("TrafficRequest"), responseWait)
+	for _, id := range []int{0, 3} {
+		clients.expectNone(t, id, isMessage(endpoint.EndpointDisconnectedMessage{}), 0)
+		clients.expectNone(t, id, isMessage(endpoint.EndpointImpairmentMessage{}), 0)
+	}
+}
+
+func TestEndpointStartTrafficIsIndependent(t *testing.T) {
+
+	const numEndpoints = 3
+	eventChan := make(chan event.Event)
+	clients := newRecordingClients(numEndpoints)
+
+	manager := endpoint.NewManager(eventChan,
+		endpoint.WithConfig(generateConfig(numEndpoints, configGenerators{randomMaxConnsGenerator, randomCharStringGenerator})),
+		endpoint.WithWebSocketTarget(clients))
+	manager.Start(context.Background(), &sync.WaitGroup{})
+
+	for id := 0; id < numEndpoints; id++ {
+		eventChan <- event.Event{Destination: id, Event: event.ConnectEvent{}}
+		clients.expect(t, id, isMessage(endpoint.EndpointConnectedMessage{}))
+	}
+
+	// Traffic on endpoint 0 only, then stop it again - 1 and 2 should stay on heartbeats throughout.
+	eventChan <- event.Event{Destination: 0, Event: event.StartTrafficEvent{}}
+	eventChan <- event.Event{Destination: 0, Event: event.StopTrafficEvent{}}
+	eventChan <- event.Event{Destination: 0, Event: event.DisconnectEvent{}}
+	clients.expect(t, 0, isMessage(endpoint.EndpointDisconnectedMessage{}))
+
+	for id := 1; id < numEndpoints; id++ {
+		clients.expect(t, id, isTraffic("TrafficRequest"))
+		clients.expect(t, id, isTraffic("TrafficResponse"))
+		clients.expect(t, id, isTraffic("TrafficRequest"))
+		clients.expectNone(t, id, isMessage(endpoint.EndpointDisconnectedMessage{}), 0)
+	}
+}
+
+// Long enough for a heartbeat interval plus the client render latency.
+const (
+	messageWait  = 4 * time.Second
+	responseWait = 1 * time.Second
+)
+
+type messageMatcher func(interface{}) bool
+
+func isMessage(want interface{}) messageMatcher {
+	return func(got interface{}) bool { return reflect.TypeOf(got) == reflect.TypeOf(want) }
+}
+
+func isTraffic(id string) messageMatcher {
+	return func(got interface{}) bool {
+		msg, ok := got.(endpoint.TrafficMessage)
+		return ok && msg.ID == id
+	}
+}
+
+// isGenerated is isTraffic, leaving out heartbeats.
+func isGenerated(id string) messageMatcher {
+	return func(got interface{}) bool {
+		msg, ok := got.(endpoint.TrafficMessage)
+		return ok && msg.ID == id && msg.Character != "❤️"
+	}
+}
+
+// recordingClients stands in for the websocket manager, capturing everything sent per endpoint.
+type recordingClients struct {
+	received map[int]chan interface{}
+}
+
+func newRecordingClients(numEndpoints int) *recordingClients {
+	c := &recordingClients{received: make(map[int]chan interface{}, numEndpoints)}
+	for i := 0; i < numEndpoints; i++ {
+		c.received[i] = make(chan interface{}, 1024)
+	}
+	return c
+}
+
+func (c *recordingClients) GetSingleRequestSender(id int) func(interface{}) error {
+	return func(payload interface{}) error {
+		c.received[id] <- payload
+		return nil
+	}
+}
+
+// expect skips messages until one matches, failing if none arrives in time.
+func (c *recordingClients) expect(t *testing.T, id int, match messageMatcher) {
+	t.Helper()
+	timeout := time.After(messageWait)
+	for {
+		select {
+		case msg := <-c.received[id]:
+			if match(msg) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("endpoint %d: expected message never arrived", id)
+		}
+	}
+}
+
+// expectNone fails if a matching message arrives within the wait, consuming everything it sees.
+func (c *recordingClients) expectNone(t *testing.T, id int, match messageMatcher, wait time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(wait)
+	for {
+		select {
+		case msg := <-c.received[id]:
+			if match(msg) {
+				t.Fatalf("endpoint %d: unexpected message %#v", id, msg)
+			}
+			continue
+		default:
+		}
+		if time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEndpointStatus(t *testing.T) {
+
+	const numEndpoints = 2
+	eventChan := make(chan event.Event)
+	clients := newRecordingClients(numEndpoints)
+
+	manager := endpoint.NewManager(eventChan,
+		endpoint.WithConfig(generateConfig(numEndpoints, configGenerators{randomMaxConnsGenerator, randomCharStringGenerator})),
+		endpoint.WithWebSocketTarget(clients))
+	manager.Start(context.Background(), &sync.WaitGroup{})
+
+	send := func(id int, e fmt.Stringer) error {
+		result := make(chan error, 1)
+		eventChan <- event.Event{Destination: id, Event: e, Result: result}
+		return <-result
+	}
+
+	if err := send(0, event.ConnectEvent{}); err != nil {
+		t.Fatalf("connect rejected: %s", err)
+	}
+	if err := send(0, event.DelayLongEvent{}); err != nil {
+		t.Fatalf("delay rejected: %s", err)
+	}
+	if err := send(1, event.StopTrafficEvent{}); err != event.ErrRejected {
+		t.Fatalf("expected stop traffic on a down endpoint to be rejected, got %v", err)
+	}
+
+	status, ok := manager.EndpointStatus(0)
+	if !ok || status.State != "UpWaiting" || status.ResponseDelayMS != 3000 || status.LastEvent != "DelayLongEvent" {
+		t.Fatalf("unexpected status for endpoint 0: %+v", status)
+	}
+	status, ok = manager.EndpointStatus(1)
+	if !ok || status.State != "Down" || status.LastEvent != "StopTrafficEvent" {
+		t.Fatalf("unexpected status for endpoint 1: %+v", status)
+	}
+	if _, ok := manager.EndpointStatus(numEndpoints); ok {
+		t.Fatalf("status reported for an endpoint that doesn't exist")
+	}
+	if statuses := manager.EndpointStatuses(); len(statuses) != numEndpoints {
+		t.Fatalf("expected %d statuses, got %d", numEndpoints, len(statuses))
+	}
+}
+
+func TestShutdownDrainsTraffic(t *testing.T) {
+
+	const numEndpoints = 2
+	eventChan := make(chan event.Event)
+	clients := newRecordingClients(numEndpoints)
+
+	manager := endpoint.NewManager(eventChan,
+		endpoint.WithConfig(generateConfig(numEndpoints, configGenerators{randomMaxConnsGenerator, randomCharStringGenerator})),
+		endpoint.WithWebSocketTarget(clients))
+	ctx, shutdown := context.WithCancel(context.Background())
+	manager.Start(ctx, &sync.WaitGroup{})
+
+	// Endpoint 0's heartbeat takes 3s to answer, endpoint 1 is never going to answer its own.
+	eventChan <- event.Event{Destination: 0, Event: event.DelayLongEvent{}}
+	eventChan <- event.Event{Destination: 1, Event: event.StopRespondingEvent{}}
+	for id := 0; id < numEndpoints; id++ {
+		eventChan <- event.Event{Destination: id, Event: event.ConnectEvent{}}
+		clients.expect(t, id, isTraffic("TrafficRequest"))
+	}
+
+	// Neither holds up shutdown, their responses are abandoned.
+	shutdown()
+	waitCtx, cancel := context.WithTimeout(context.Background(), responseWait)
+	defer cancel()
+	if err := manager.Wait(waitCtx); err != nil {
+		t.Fatalf("manager didn't shut down: %s", err)
+	}
+
+	for id := 0; id < numEndpoints; id++ {
+		clients.expect(t, id, func(msg interface{}) bool {
+			disconnected, ok := msg.(endpoint.EndpointDisconnectedMessage)
+			return ok && disconnected.Reason != ""
+		})
+		clients.expectNone(t, id, func(msg interface{}) bool { _, ok := msg.(endpoint.TrafficMessage); return ok }, responseWait)
+	}
+}
+
+func TestClosedEventChannelShutsDown(t *testing.T) {
+
+	eventChan := make(chan event.Event)
+	clients := newRecordingClients(1)
+
+	manager := endpoint.NewManager(eventChan,
+		endpoint.WithConfig(generateConfig(1, configGenerators{randomMaxConnsGenerator, randomCharStringGenerator})),
+		endpoint.WithWebSocketTarget(clients))
+	manager.Start(context.Background(), &sync.WaitGroup{})
+
+	eventChan <- event.Event{Destination: 0, Event: event.ConnectEvent{}}
+	close(eventChan)
+
+	waitCtx, cancel := context.WithTimeout(context.Background(), responseWait)
+	defer cancel()
+	if err := manager.Wait(waitCtx); err != nil {
+		t.Fatalf("manager didn't shut down: %s", err)
+	}
+	clients.expect(t, 0, func(msg interface{}) bool {
+		disconnected, ok := msg.(endpoint.EndpointDisconnectedMessage)
+		return ok && disconnected.Reason == "ServerShutdown"
+	})
+}
+
+func TestHealthFollowsLifecycle(t *testing.T) {
+
+	const numEndpoints = 2
+	manager := endpoint.NewManager(make(chan event.Event),
+		endpoint.WithConfig(generateConfig(numEndpoints, configGenerators{randomMaxConnsGenerator, randomCharStringGenerator})),
+		endpoint.WithWebSocketTarget(newRecordingClients(numEndpoints)))
+	if manager.Live().OK || manager.Ready().OK {
+		t.Fatalf("healthy before starting: %+v, %+v", manager.Live(), manager.Ready())
+	}
+
+	ctx, shutdown := context.WithCancel(context.Background())
+	manager.Start(ctx, &sync.WaitGroup{})
+	if !manager.Live().OK || !manager.Ready().OK {
+		t.Fatalf("unhealthy once started: %+v, %+v", manager.Live(), manager.Ready())
+	}
+
+	shutdown()
+	deadline := time.Now().Add(messageWait)
+	for manager.Live().OK {
+		if time.Now().After(deadline) {
+			t.Fatalf("still live after shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if manager.Ready().OK {
+		t.Fatalf("still ready after shutdown: %+v", manager.Ready())
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+
+	const numEndpoints = 3
+	eventChan := make(chan event.Event)
+	clients := newRecordingClients(numEndpoints)
+	config := generateConfig(numEndpoints, configGenerators{randomMaxConnsGenerator, randomCharStringGenerator})
+
+	manager := endpoint.NewManager(eventChan,
+		endpoint.WithConfig(config[:2]),
+		endpoint.WithWebSocketTarget(clients))
+	manager.Start(context.Background(), &sync.WaitGroup{})
+
+	send := func(id int, e fmt.Stringer) error {
+		result := make(chan error, 1)
+		eventChan <- event.Event{Destination: id, Event: e, Result: result}
+		return <-result
+	}
+
+	if err := send(1, event.ConnectEvent{}); err != nil {
+		t.Fatalf("connect rejected: %s", err)
+	}
+	if err := send(2, event.ConnectEvent{}); err != event.ErrUnknownDestination {
+		t.Fatalf("expected endpoint 2 to be unknown before reconfiguring, got %v", err)
+	}
+
+	manager.Reconfigure([]endpoint.ManagableEndpoint{config[0], config[2]}, []endpoint.ImpairmentProfile{{Name: "Slow", Distribution: "uniform", MinMS: 100, MaxMS: 200}})
+
+	clients.expect(t, 1, func(msg interface{}) bool {
+		disconnected, ok := msg.(endpoint.EndpointDisconnectedMessage)
+		return ok && disconnected.Reason == "EndpointRemoved"
+	})
+	if err := send(1, event.DisconnectEvent{}); err != event.ErrUnknownDestination {
+		t.Fatalf("expected removed endpoint 1 to be unknown, got %v", err)
+	}
+	if _, ok := manager.EndpointStatus(1); ok {
+		t.Fatalf("status still reported for removed endpoint 1")
+	}
+
+	if err := send(2, event.ConnectEvent{}); err != nil {
+		t.Fatalf("connect on added endpoint rejected: %s", err)
+	}
+	if err := send(2, event.ImpairmentProfileEvent{Profile: "Slow"}); err != nil {
+		t.Fatalf("reloaded impairment profile rejected: %s", err)
+	}
+	if statuses := manager.EndpointStatuses(); len(statuses) != 2 || statuses[0].ID != 0 || statuses[1].ID != 2 {
+		t.Fatalf("unexpected statuses after reconfiguring: %+v", statuses)
+	}
+}
+
+func TestReconfigureReaddsEndpoint(t *testing.T) {
+
+	eventChan := make(chan event.Event)
+	clients := newRecordingClients(2)
+	clients.received[1] = make(chan interface{}) // So endpoint 1 can't finish until it's read.
+	config := generateConfig(2, configGenerators{randomMaxConnsGenerator, randomCharStringGenerator})
+
+	manager := endpoint.NewManager(eventChan,
+		endpoint.WithConfig(config),
+		endpoint.WithWebSocketTarget(clients))
+	manager.Start(context.Background(), &sync.WaitGroup{})
+
+	send := func(id int, e fmt.Stringer) error {
+		result := make(chan error, 1)
+		eventChan <- event.Event{Destination: id, Event: e, Result: result}
+		return <-result
+	}
+	if err := send(1, event.ConnectEvent{}); err != nil {
+		t.Fatalf("connect rejected: %s", err)
+	}
+
+	// Removed and straight back, as two quick reloads would, while the old processor is stuck.
+	go func() {
+		manager.Reconfigure(config[:1], nil)
+		manager.Reconfigure(config, nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	clients.expect(t, 1, func(msg interface{}) bool {
+		disconnected, ok := msg.(endpoint.EndpointDisconnectedMessage)
+		return ok && disconnected.Reason == "EndpointRemoved"
+	})
+
+	// Once the router's moved on, the new processor's status must be there, whatever the old one did.
+	if err := send(0, event.ConnectEvent{}); err != nil {
+		t.Fatalf("connect rejected: %s", err)
+	}
+	if status, ok := manager.EndpointStatus(1); !ok || status.State != "Down" {
+		t.Fatalf("expected the re-added endpoint to be down, got %+v, %v", status, ok)
+	}
+}
+
+func TestMustReconnectForNewMaxConns(t *testing.T) {
+
+	eventChan := make(chan event.Event)
+	clients := newRecordingClients(3)
+	config := generateConfig(3, configGenerators{randomMaxConnsGenerator, randomCharStringGenerator})
+
+	manager := endpoint.NewManager(eventChan,
+		endpoint.WithConfig(config),
+		endpoint.WithWebSocketTarget(clients))
+	manager.Start(context.Background(), &sync.WaitGroup{})
+
+	result := make(chan error, 1)
+	eventChan <- event.Event{Destination: 1, Event: event.ConnectEvent{}, Result: result}
+	if err := <-result; err != nil {
+		t.Fatalf("connect rejected: %s", err)
+	}
+
+	changed := make([]endpoint.ManagableEndpoint, len(config))
+	copy(changed, config)
+	for i := range changed {
+		changed[i].MaxConns++
+	}
+	changed = append(changed, endpoint.ManagableEndpoint{ID: 3, MaxConns: 1})
+
+	// Endpoints 0 and 2 pick up the change when they connect, and 3 is new.
+	if ids := manager.MustReconnect(changed); len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("expected only connected endpoint 1 to need reconnecting, got %v", ids)
+	}
+	if ids := manager.MustReconnect(config); len(ids) != 0 {
+		t.Fatalf("expected nothing to need reconnecting when maxConns is unchanged, got %v", ids)
+	}
+}
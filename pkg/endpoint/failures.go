@@ -0,0 +1,170 @@
+package endpoint
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"endpoint-visualiser-server/pkg/clock"
+	"endpoint-visualiser-server/pkg/event"
+	"endpoint-visualiser-server/pkg/logging"
+)
+
+// FailureModes are partial failures layered on top of an endpoint's response delay.
+type FailureModes struct {
+	DropPercent        int `json:"dropPercent"`  // Requests that never get a response.
+	ErrorPercent       int `json:"errorPercent"` // Requests that get a TrafficError instead of a response.
+	JitterMS           int `json:"jitterMS"`     // Responses land uniformly within +/- this of the base delay.
+	BrownoutPeriodMS   int `json:"brownoutPeriodMS"`
+	BrownoutDurationMS int `json:"brownoutDurationMS"` // For this long every period, responses are as slow as longResponseDelayMS.
+}
+
+func (f FailureModes) brownoutChanged(previous FailureModes) bool {
+	return f.BrownoutPeriodMS != previous.BrownoutPeriodMS || f.BrownoutDurationMS != previous.BrownoutDurationMS
+}
+
+type responseOutcome int
+
+const (
+	outcomeRespond responseOutcome = iota
+	outcomeDrop
+	outcomeError
+)
+
+// plannedResponse is how a request will be answered, decided when it's sent.
+type plannedResponse struct {
+	outcome           responseOutcome
+	delayMS           int
+	stoppedResponding bool
+}
+
+func (b responseBehaviour) planResponse(rng *rand.Rand, inBrownout bool) plannedResponse {
+	outcome, delayMS := b.nextResponse(rng, inBrownout)
+	return plannedResponse{outcome, delayMS, b.delay.nominalMS() == stopRespondingMS}
+}
+
+// responseBehaviour is everything the traffic initiator needs to decide how to answer a
+// request, and how fast to send them.
+type responseBehaviour struct {
+	delay     responseDelay
+	failures  FailureModes
+	targetTPS float64
+}
+
+func (b responseBehaviour) nextResponse(rng *rand.Rand, inBrownout bool) (responseOutcome, int) {
+	delayMS := b.delay.nextMS(rng)
+	if delayMS == stopRespondingMS {
+		return outcomeDrop, 0
+	}
+
+	if inBrownout && delayMS < longResponseDelayMS {
+		delayMS = longResponseDelayMS
+	}
+	if jitter := b.failures.JitterMS; jitter > 0 {
+		delayMS += rng.Intn(2*jitter+1) - jitter
+		if delayMS < 0 {
+			delayMS = 0
+		}
+	}
+
+	roll := rng.Intn(100)
+	switch {
+	case roll < b.failures.DropPercent:
+		return outcomeDrop, 0
+	case roll < b.failures.DropPercent+b.failures.ErrorPercent:
+		return outcomeError, delayMS
+	}
+	return outcomeRespond, delayMS
+}
+
+// brownoutCycle flips an endpoint in and out of brownout. It belongs to a single traffic initiator.
+type brownoutCycle struct {
+	failures FailureModes
+	timer    clock.Timer // nil when brownouts aren't configured
+	active   bool
+}
+
+func newBrownoutCycle(c clock.Clock, failures FailureModes) *brownoutCycle {
+	b := &brownoutCycle{failures: failures}
+	if failures.BrownoutPeriodMS > 0 && failures.BrownoutDurationMS > 0 {
+		b.timer = c.NewTimer(b.untilNextFlip())
+	}
+	return b
+}
+
+func (b *brownoutCycle) timerChan() <-chan time.Time {
+	if b.timer == nil {
+		return nil // Blocks forever, so never selected.
+	}
+	return b.timer.C()
+}
+
+func (b *brownoutCycle) toggle() bool {
+	b.active = !b.active
+	b.timer.Reset(b.untilNextFlip())
+	return b.active
+}
+
+func (b *brownoutCycle) untilNextFlip() time.Duration {
+	if b.active {
+		return time.Duration(b.failures.BrownoutDurationMS) * time.Millisecond
+	}
+	return time.Duration(b.failures.BrownoutPeriodMS-b.failures.BrownoutDurationMS) * time.Millisecond
+}
+
+func (b *brownoutCycle) isActive() bool { return b.active }
+
+func (b *brownoutCycle) stop() {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+}
+
+// Failure Mode Handlers
+type EndpointFailureModesMessage struct {
+	RequestID messageID `json:"id"`
+	FailureModes
+}
+
+type EndpointBrownoutMessage struct {
+	RequestID messageID `json:"id"`
+	Active    bool      `json:"active"`
+}
+
+func (m *Manager) sendBrownout(id int, sender ClientSender, active bool) {
+	m.logger.Info("Brownout", logging.EndpointID, id, "active", active)
+	if err := sender(EndpointBrownoutMessage{endpointBrownout, active}); err != nil {
+		m.logger.Warn("Couldn't send brownout to clients", logging.EndpointID, id, logging.Err, err)
+	}
+}
+
+func failureModeEventPredicate(currentState endpointProcessingState) bool { return true }
+
+func (m *Manager) failureModeHandler(previousState endpointProcessingState, ep *managedEndpoint, failures FailureModes) (interface{}, endpointProcessingState) {
+	newState := previousState
+	newState.failures = failures
+	m.changeBehaviour(ep, newState.behaviour())
+	return EndpointFailureModesMessage{endpointFailureModes, failures}, newState
+}
+
+// failureModeEventHandler builds a handler for one of the argument carrying failure mode events.
+func (m *Manager) failureModeEventHandler(e fmt.Stringer) (eventHandler, bool) {
+	return eventHandler{failureModeEventPredicate, func(previousState endpointProcessingState, ep *managedEndpoint) (interface{}, endpointProcessingState) {
+		failures := previousState.failures
+		switch e := e.(type) {
+		case event.DropResponsesEvent:
+			failures.DropPercent = e.Percent
+		case event.ErrorResponsesEvent:
+			failures.ErrorPercent = e.Percent
+		case event.JitterEvent:
+			failures.JitterMS = e.MS
+		case event.BrownoutEvent:
+			failures.BrownoutPeriodMS, failures.BrownoutDurationMS = e.PeriodMS, e.DurationMS
+		}
+		return m.failureModeHandler(previousState, ep, failures)
+	}}, true
+}
+
+func (m *Manager) clearFailuresEventAction(previousState endpointProcessingState, ep *managedEndpoint) (interface{}, endpointProcessingState) {
+	return m.failureModeHandler(previousState, ep, FailureModes{})
+}
@@ -0,0 +1,378 @@
+package endpoint
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"endpoint-visualiser-server/pkg/event"
+	"endpoint-visualiser-server/pkg/logging"
+)
+
+// Generator decides the shape of an endpoint's traffic. Next is called as each request is sent,
+// and returns the request's character and how long to wait before sending the next one. A new
+// Generator is built every time traffic starts, so it may keep state between calls. It should
+// draw any random numbers from rng, so that seeded traffic is reproducible.
+type Generator interface {
+	Next(rng *rand.Rand, now time.Time) (character string, wait time.Duration)
+}
+
+// GeneratorConfig picks a registered generator by Name and configures it. Which fields are
+// used depends on the generator:
+//
+//	random:   neither rate nor file, waits are uniform between 0 and 2s (the default)
+//	constant: RatePerSecond
+//	poisson:  RatePerSecond, with exponentially distributed waits
+//	bursty:   RatePerSecond (Poisson) for OnMS, then nothing for OffMS
+//	diurnal:  Poisson, ramping from MinRatePerSecond up to RatePerSecond and back every PeriodMS
+//	trace:    TraceFile, a CSV whose first column is each request's time, see readTrace
+//
+// Characters are what requests carry, picked at random. It defaults to a small set of emoji.
+type GeneratorConfig struct {
+	Name             string   `json:"name"`
+	RatePerSecond    float64  `json:"ratePerSecond,omitempty"`
+	MinRatePerSecond float64  `json:"minRatePerSecond,omitempty"`
+	OnMS             int      `json:"onMS,omitempty"`
+	OffMS            int      `json:"offMS,omitempty"`
+	PeriodMS         int      `json:"periodMS,omitempty"`
+	TraceFile        string   `json:"traceFile,omitempty"`
+	Characters       []string `json:"characters,omitempty"`
+}
+
+// GeneratorFactory builds a generator from its config, reporting what's wrong with the config if
+// it can't.
+type GeneratorFactory func(config GeneratorConfig) (Generator, error)
+
+const (
+	RandomGenerator   = "random"
+	ConstantGenerator = "constant"
+	PoissonGenerator  = "poisson"
+	BurstyGenerator   = "bursty"
+	DiurnalGenerator  = "diurnal"
+	TraceGenerator    = "trace"
+)
+
+var (
+	generatorLock sync.RWMutex
+	generators    = map[string]GeneratorFactory{
+		RandomGenerator:   newRandomGenerator,
+		ConstantGenerator: newConstantGenerator,
+		PoissonGenerator:  newPoissonGenerator,
+		BurstyGenerator:   newBurstyGenerator,
+		DiurnalGenerator:  newDiurnalGenerator,
+		TraceGenerator:    newTraceGenerator,
+	}
+)
+
+// RegisterGenerator makes a generator available to config by name, replacing any already
+// registered under that name.
+func RegisterGenerator(name string, factory GeneratorFactory) {
+	generatorLock.Lock()
+	defer generatorLock.Unlock()
+	generators[name] = factory
+}
+
+// Generators lists the registered generator names, sorted.
+func Generators() []string {
+	generatorLock.RLock()
+	defer generatorLock.RUnlock()
+	names := make([]string, 0, len(generators))
+	for name := range generators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewGenerator builds the generator config names. An empty name is the random generator.
+func NewGenerator(config GeneratorConfig) (Generator, error) {
+	name := config.Name
+	if name == "" {
+		name = RandomGenerator
+	}
+	generatorLock.RLock()
+	factory, ok := generators[name]
+	generatorLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown generator %q, expected one of %s", name, strings.Join(Generators(), ", "))
+	}
+
+	generator, err := factory(config)
+	if err != nil {
+		return nil, fmt.Errorf("generator %s: %w", name, err)
+	}
+	return generator, nil
+}
+
+// trafficGenerator is what StartTrafficEvent switches the endpoint to. A generator that was fine
+// when the config was validated can still fail here, e.g. if its trace file has gone.
+func (m *Manager) trafficGenerator(ep *managedEndpoint) Generator {
+	generator, err := NewGenerator(ep.config.Generator)
+	if err != nil {
+		m.logger.Warn("Falling back to random traffic", logging.EndpointID, ep.config.ID, logging.Err, err)
+		generator, _ = newRandomGenerator(GeneratorConfig{Characters: ep.config.Generator.Characters})
+	}
+	return generator
+}
+
+var defaultCharacters = []string{"🐷", "🐤", "🏈", "⚽", "🍋", "🍌"}
+
+// characters picks each request's character from the configured set.
+type characters []string
+
+func newCharacters(config GeneratorConfig) characters {
+	if len(config.Characters) == 0 {
+		return defaultCharacters
+	}
+	return config.Characters
+}
+
+func (c characters) pick(rng *rand.Rand) string {
+	return c[rng.Intn(len(c))]
+}
+
+// heartbeatGenerator keeps a connected endpoint ticking over while it's not receiving traffic.
+type heartbeatGenerator struct{}
+
+func (heartbeatGenerator) Next(rng *rand.Rand, now time.Time) (string, time.Duration) {
+	return "❤️", time.Duration(heartbeatIntervalMS) * time.Millisecond
+}
+
+type randomGenerator struct{ characters }
+
+func newRandomGenerator(config GeneratorConfig) (Generator, error) {
+	return randomGenerator{newCharacters(config)}, nil
+}
+
+func (g randomGenerator) Next(rng *rand.Rand, now time.Time) (string, time.Duration) {
+	return g.pick(rng), time.Duration(rng.Intn(maxWaitForNextMessageMS)) * time.Millisecond
+}
+
+type constantGenerator struct {
+	characters
+	interval time.Duration
+}
+
+// checkRate holds generators to the rates a TargetTPSEvent can ask for. Much faster and waits
+// round down to nothing, leaving the initiator spinning.
+func checkRate(rate float64) error {
+	if !(rate > 0 && rate <= event.MaxTargetTPS) { // Also catches NaN.
+		return fmt.Errorf("ratePerSecond must be positive and at most %d", event.MaxTargetTPS)
+	}
+	return nil
+}
+
+func newConstantGenerator(config GeneratorConfig) (Generator, error) {
+	if err := checkRate(config.RatePerSecond); err != nil {
+		return nil, err
+	}
+	return constantGenerator{newCharacters(config), seconds(1 / config.RatePerSecond)}, nil
+}
+
+func (g constantGenerator) Next(rng *rand.Rand, now time.Time) (string, time.Duration) {
+	return g.pick(rng), g.interval
+}
+
+type poissonGenerator struct {
+	characters
+	rate float64
+}
+
+func newPoissonGenerator(config GeneratorConfig) (Generator, error) {
+	if err := checkRate(config.RatePerSecond); err != nil {
+		return nil, err
+	}
+	return poissonGenerator{newCharacters(config), config.RatePerSecond}, nil
+}
+
+func (g poissonGenerator) Next(rng *rand.Rand, now time.Time) (string, time.Duration) {
+	return g.pick(rng), seconds(rng.ExpFloat64() / g.rate)
+}
+
+// burstyGenerator's on and off periods are timed from its first request.
+type burstyGenerator struct {
+	poissonGenerator
+	on, off time.Duration
+	started time.Time
+}
+
+func newBurstyGenerator(config GeneratorConfig) (Generator, error) {
+	if err := checkRate(config.RatePerSecond); err != nil {
+		return nil, err
+	}
+	if config.OnMS <= 0 || config.OffMS <= 0 {
+		return nil, fmt.Errorf("needs onMS and offMS to be positive")
+	}
+	return &burstyGenerator{
+		poissonGenerator: poissonGenerator{newCharacters(config), config.RatePerSecond},
+		on:               time.Duration(config.OnMS) * time.Millisecond,
+		off:              time.Duration(config.OffMS) * time.Millisecond,
+	}, nil
+}
+
+func (g *burstyGenerator) Next(rng *rand.Rand, now time.Time) (string, time.Duration) {
+	if g.started.IsZero() {
+		g.started = now
+	}
+	character, wait := g.poissonGenerator.Next(rng, now)
+
+	// A request that would land in an off period waits for the next burst instead.
+	period := g.on + g.off
+	into := (now.Sub(g.started) + wait) % period
+	if into >= g.on {
+		wait += period - into
+	}
+	return character, wait
+}
+
+// diurnalGenerator is a Poisson process whose rate follows a cosine, starting at its minimum.
+// Arrivals are drawn at the peak rate and thinned down to the rate at the time.
+type diurnalGenerator struct {
+	characters
+	min, peak float64
+	period    time.Duration
+	started   time.Time
+}
+
+func newDiurnalGenerator(config GeneratorConfig) (Generator, error) {
+	if err := checkRate(config.RatePerSecond); err != nil {
+		return nil, err
+	}
+	if config.PeriodMS <= 0 {
+		return nil, fmt.Errorf("periodMS must be positive")
+	}
+	if config.MinRatePerSecond < 0 || config.MinRatePerSecond > config.RatePerSecond {
+		return nil, fmt.Errorf("minRatePerSecond must be between 0 and ratePerSecond")
+	}
+	return &diurnalGenerator{
+		characters: newCharacters(config),
+		min:        config.MinRatePerSecond,
+		peak:       config.RatePerSecond,
+		period:     time.Duration(config.PeriodMS) * time.Millisecond,
+	}, nil
+}
+
+func (g *diurnalGenerator) rateAt(t time.Duration) float64 {
+	phase := 2 * math.Pi * float64(t%g.period) / float64(g.period)
+	return g.min + (g.peak-g.min)*(1-math.Cos(phase))/2
+}
+
+func (g *diurnalGenerator) Next(rng *rand.Rand, now time.Time) (string, time.Duration) {
+	if g.started.IsZero() {
+		g.started = now
+	}
+	since := now.Sub(g.started)
+	var wait time.Duration
+	for {
+		wait += seconds(rng.ExpFloat64() / g.peak)
+		if rng.Float64()*g.peak < g.rateAt(since+wait) {
+			return g.pick(rng), wait
+		}
+	}
+}
+
+// traceGenerator replays the gaps between recorded requests, starting over at the end of the trace.
+type traceGenerator struct {
+	characters
+	gaps []time.Duration // gaps[i] is the wait after request i, the last wraps round to the first.
+	next int
+}
+
+func newTraceGenerator(config GeneratorConfig) (Generator, error) {
+	if config.TraceFile == "" {
+		return nil, fmt.Errorf("traceFile is required")
+	}
+	file, err := os.Open(config.TraceFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	times, err := readTrace(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", config.TraceFile, err)
+	}
+	gaps := make([]time.Duration, len(times))
+	for i := 1; i < len(times); i++ {
+		gaps[i-1] = times[i].Sub(times[i-1])
+	}
+	// There's no gap to measure between the end of the trace and its start again, use the mean.
+	gaps[len(gaps)-1] = times[len(times)-1].Sub(times[0]) / time.Duration(len(times)-1)
+	return &traceGenerator{characters: newCharacters(config), gaps: gaps}, nil
+}
+
+func (g *traceGenerator) Next(rng *rand.Rand, now time.Time) (string, time.Duration) {
+	wait := g.gaps[g.next]
+	g.next = (g.next + 1) % len(g.gaps)
+	return g.pick(rng), wait
+}
+
+// readTrace reads request times from the first column of a CSV, either as RFC 3339 timestamps
+// or as seconds, e.g. from the start of the capture or Unix time. A header row is skipped, and
+// any other columns are ignored. A first row that isn't a time is only taken as a header if it
+// has no digits, so a malformed first request is reported rather than dropped. Times must not go backwards, and must not all be the same, as
+// a trace with no gaps would send requests as fast as the endpoint could loop.
+func readTrace(r io.Reader) ([]time.Time, error) {
+	records := csv.NewReader(r)
+	records.FieldsPerRecord = -1
+	records.TrimLeadingSpace = true
+
+	var times []time.Time
+	for row := 1; ; row++ {
+		record, err := records.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		t, err := parseTraceTime(record[0])
+		switch {
+		case err != nil && row == 1 && !strings.ContainsAny(record[0], "0123456789"):
+			continue // Header
+		case err != nil:
+			return nil, fmt.Errorf("row %d: %w", row, err)
+		case len(times) > 0 && t.Before(times[len(times)-1]):
+			return nil, fmt.Errorf("row %d: time goes backwards", row)
+		}
+		times = append(times, t)
+	}
+	switch {
+	case len(times) < 2:
+		return nil, fmt.Errorf("trace needs at least two requests")
+	case !times[len(times)-1].After(times[0]):
+		return nil, fmt.Errorf("trace's requests are all at the same time")
+	}
+	return times, nil
+}
+
+// maxTraceSeconds is as far from 1970 as a trace time in seconds can be, about 292 years.
+const maxTraceSeconds = float64(math.MaxInt64 / int64(time.Second))
+
+func parseTraceTime(field string) (time.Time, error) {
+	if secs, err := strconv.ParseFloat(field, 64); err == nil {
+		// ParseFloat takes NaN and Inf, and seconds overflows well before either.
+		if !(math.Abs(secs) <= maxTraceSeconds) {
+			return time.Time{}, fmt.Errorf("%q is out of range", field)
+		}
+		return time.Unix(0, 0).Add(seconds(secs)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, field)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither seconds nor an RFC 3339 time", field)
+	}
+	return t, nil
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
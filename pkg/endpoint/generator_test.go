@@ -0,0 +1,88 @@
+package endpoint_test
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"endpoint-visualiser-server/pkg/endpoint"
+)
+
+func TestGeneratorsKeepTheirShape(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	start := time.Unix(0, 0)
+
+	constant, err := endpoint.NewGenerator(endpoint.GeneratorConfig{Name: endpoint.ConstantGenerator, RatePerSecond: 4, Characters: []string{"x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if char, wait := constant.Next(rng, start); char != "x" || wait != 250*time.Millisecond {
+		t.Errorf("constant gave %q after %v, want \"x\" after 250ms", char, wait)
+	}
+
+	bursty, err := endpoint.NewGenerator(endpoint.GeneratorConfig{Name: endpoint.BurstyGenerator, RatePerSecond: 20, OnMS: 100, OffMS: 900})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := start
+	for i := 0; i < 1000; i++ {
+		_, wait := bursty.Next(rng, now)
+		now = now.Add(wait)
+		if into := now.Sub(start) % time.Second; into >= 100*time.Millisecond {
+			t.Fatalf("request %d landed %v into the cycle, outside the burst", i, into)
+		}
+	}
+}
+
+func TestTraceGeneratorReplaysGaps(t *testing.T) {
+	trace := filepath.Join(t.TempDir(), "trace.csv")
+	csv := "time,path\n0.5,/a\n0.75,/b\n1.5,/c\n"
+	if err := os.WriteFile(trace, []byte(csv), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	generator, err := endpoint.NewGenerator(endpoint.GeneratorConfig{Name: endpoint.TraceGenerator, TraceFile: trace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	want := []time.Duration{250 * time.Millisecond, 750 * time.Millisecond, 500 * time.Millisecond, 250 * time.Millisecond}
+	for i, w := range want {
+		if _, wait := generator.Next(rng, time.Time{}); wait != w {
+			t.Errorf("gap %d = %v, want %v", i, wait, w)
+		}
+	}
+}
+
+func TestNewGeneratorRejectsBadConfig(t *testing.T) {
+	dir := t.TempDir()
+	traces := map[string]string{
+		"instant.csv":   "2.5\n2.5\n2.5\n",
+		"nan.csv":       "time\n1\nNaN\n3\n",
+		"infinite.csv":  "time\n1\n2\nInf\n",
+		"malformed.csv": "1.5s\n2\n3\n", // Not a header, it has digits.
+	}
+	var bad []endpoint.GeneratorConfig
+	for name, csv := range traces {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(csv), 0644); err != nil {
+			t.Fatal(err)
+		}
+		bad = append(bad, endpoint.GeneratorConfig{Name: endpoint.TraceGenerator, TraceFile: path})
+	}
+
+	for _, config := range append([]endpoint.GeneratorConfig{
+		{Name: "lumpy"},
+		{Name: endpoint.PoissonGenerator},
+		{Name: endpoint.ConstantGenerator, RatePerSecond: 1e10},
+		{Name: endpoint.BurstyGenerator, RatePerSecond: 2000, OnMS: 100, OffMS: 100},
+		{Name: endpoint.DiurnalGenerator, RatePerSecond: 1, MinRatePerSecond: 2, PeriodMS: 1000},
+		{Name: endpoint.TraceGenerator, TraceFile: filepath.Join(dir, "missing.csv")},
+	}, bad...) {
+		if _, err := endpoint.NewGenerator(config); err == nil {
+			t.Errorf("%+v: expected an error", config)
+		}
+	}
+}
@@ -1,5 +1,11 @@
 package endpoint
 
+import (
+	"fmt"
+
+	"endpoint-visualiser-server/pkg/event"
+)
+
 type messageID string
 
 const (
@@ -8,61 +14,79 @@ const (
 	endpointImpaired     messageID = "EndpointImpaired"
 	trafficRequest       messageID = "TrafficReqeust"
 	trafficResponse      messageID = "TrafficResponse"
+	endpointFailureModes messageID = "EndpointFailureModes"
+	endpointBrownout     messageID = "EndpointBrownout"
+	endpointTargetTPS    messageID = "EndpointTargetTPS"
+	endpointStats        messageID = "EndpointStats"
 )
 
 type predicate func(currentState endpointProcessingState) bool
-type actionFunc func(previousState endpointProcessingState, sender ClientSender) (payload interface{}, newState endpointProcessingState)
+type actionFunc func(previousState endpointProcessingState, ep *managedEndpoint) (payload interface{}, newState endpointProcessingState)
 
 type eventHandler struct {
 	predF   predicate
 	actionF actionFunc
 }
 
-func (h eventHandler) handleEvent(previousState endpointProcessingState, sender ClientSender) (interface{}, endpointProcessingState) {
+// handlerFactory builds the handler for an event that carries an argument, e.g. "JitterEvent:200".
+// It reports false if the argument doesn't refer to anything we know about.
+type handlerFactory func(e fmt.Stringer) (eventHandler, bool)
+
+func (h eventHandler) handleEvent(previousState endpointProcessingState, ep *managedEndpoint) (interface{}, endpointProcessingState, error) {
 	if h.predF(previousState) {
-		return h.actionF(previousState, sender)
+		payload, newState := h.actionF(previousState, ep)
+		return payload, newState, nil
 	}
-	return nil, previousState
+	return nil, previousState, event.ErrRejected
 }
 
 // Connect Handler
 type EndpointConnectedMessage struct {
-	RequestID      messageID `json:"id"`
-	NumConnections int       `json:"numConnections"`
+	RequestID      messageID  `json:"id"`
+	NumConnections int        `json:"numConnections"`
+	Pool           *PoolStats `json:"pool,omitempty"`
 }
 
 func connectEventPredicate(currentState endpointProcessingState) bool {
 	return currentState.endpointState == epStateDown
 }
-func (m *Manager) connectEventAction(previousState endpointProcessingState, sender ClientSender) (interface{}, endpointProcessingState) {
-	go m.trafficInitiator(sender, heartBeatGenerator) // Start heartbeat
+func (m *Manager) connectEventAction(previousState endpointProcessingState, ep *managedEndpoint) (interface{}, endpointProcessingState) {
+	m.openPool(ep)
+	m.startTraffic(ep, heartbeatGenerator{}, previousState.behaviour()) // Start heartbeat
 	newState := previousState
 	newState.endpointState = epStateUpWaiting
-	return EndpointConnectedMessage{endpointConnected, 16}, newState
+	stats := ep.pool.stats()
+	return EndpointConnectedMessage{endpointConnected, stats.Size, &stats}, newState
 }
 
 // Disconnect Handler
 type EndpointDisconnectedMessage struct {
 	RequestID messageID `json:"id"`
+	Reason    string    `json:"reason,omitempty"`
 }
 
+const (
+	serverShutdownReason  = "ServerShutdown"
+	endpointRemovedReason = "EndpointRemoved"
+)
+
 func disconnectEventPredicate(currentState endpointProcessingState) bool {
 	return currentState.endpointState != epStateDown
 }
-func (m *Manager) disconnectEventAction(previousState endpointProcessingState, sender ClientSender) (interface{}, endpointProcessingState) {
-	m.cntl.stopChan <- struct{}{} // Stop traffic.
+func (m *Manager) disconnectEventAction(previousState endpointProcessingState, ep *managedEndpoint) (interface{}, endpointProcessingState) {
+	m.stopTraffic(ep)
+	m.closePool(ep)
 	newState := previousState
 	newState.endpointState = epStateDown
-	return EndpointDisconnectedMessage{endpointDisconnected}, newState
+	return EndpointDisconnectedMessage{RequestID: endpointDisconnected}, newState
 }
 
 // Start/Stop Traffic Handlers
 func startTrafficEventPredicate(currentState endpointProcessingState) bool {
 	return currentState.endpointState == epStateUpWaiting
 }
-func (m *Manager) startTrafficEventAction(previousState endpointProcessingState, sender ClientSender) (interface{}, endpointProcessingState) {
-	m.cntl.stopChan <- struct{}{}                         // stop existing traffic, or heartbeats
-	go m.trafficInitiator(sender, randomMessageGenerator) // Start traffic
+func (m *Manager) startTrafficEventAction(previousState endpointProcessingState, ep *managedEndpoint) (interface{}, endpointProcessingState) {
+	m.startTraffic(ep, m.trafficGenerator(ep), previousState.behaviour()) // replaces heartbeats
 	newState := previousState
 	newState.endpointState = epStateUpReceiving
 	return nil, newState
@@ -71,10 +95,8 @@ func (m *Manager) startTrafficEventAction(previousState endpointProcessingState,
 func stopTrafficEventPredicate(currentState endpointProcessingState) bool {
 	return (currentState.endpointState == epStateUpReceiving) || (currentState.endpointState == epStateImpared)
 }
-func (m *Manager) stopTrafficEventAction(previousState endpointProcessingState, sender ClientSender) (interface{}, endpointProcessingState) {
-	m.cntl.stopChan <- struct{}{}                     // stop existing traffic, or heartbeats
-	go m.trafficInitiator(sender, heartBeatGenerator) // Start heartbeats
-	m.cntl.changeDelayChan <- previousState.currentDelayState
+func (m *Manager) stopTrafficEventAction(previousState endpointProcessingState, ep *managedEndpoint) (interface{}, endpointProcessingState) {
+	m.startTraffic(ep, heartbeatGenerator{}, previousState.behaviour()) // back to heartbeats
 	newState := previousState
 	newState.endpointState = epStateUpWaiting
 	return nil, newState
@@ -85,40 +107,64 @@ type EndpointImpairmentMessage struct {
 	RequestID                messageID `json:"id"`
 	WorstImparedResponseTime int       `json:"worstResponse"`
 	ImparedResponseTime      int       `json:"time"`
+	Profile                  string    `json:"profile,omitempty"`
+	Distribution             string    `json:"distribution,omitempty"`
 }
 
-func (m *Manager) imparimentHandler(previousState endpointProcessingState, sender ClientSender, delay int) (interface{}, endpointProcessingState) {
-	m.cntl.changeDelayChan <- delay
+func (m *Manager) imparimentHandler(previousState endpointProcessingState, ep *managedEndpoint, delay responseDelay) (interface{}, endpointProcessingState) {
 	newState := previousState
 	newState.currentDelayState = delay
-	return EndpointImpairmentMessage{
+	m.changeBehaviour(ep, newState.behaviour())
+	message := EndpointImpairmentMessage{
 		RequestID:                endpointImpaired,
 		WorstImparedResponseTime: longResponseDelayMS,
-		ImparedResponseTime:      delay,
-	}, newState
+		ImparedResponseTime:      delay.nominalMS(),
+	}
+	if delay.profile != nil {
+		message.Profile = delay.profile.Name
+		message.Distribution = delay.profile.Distribution
+	}
+	return message, newState
 }
 
 func delayShortEventPredicate(currentState endpointProcessingState) bool { return true }
-func (m *Manager) delayShortEventAction(previousState endpointProcessingState, sender ClientSender) (interface{}, endpointProcessingState) {
-	return m.imparimentHandler(previousState, sender, shortResponseDelayMS)
+func (m *Manager) delayShortEventAction(previousState endpointProcessingState, ep *managedEndpoint) (interface{}, endpointProcessingState) {
+	return m.imparimentHandler(previousState, ep, fixedDelay(shortResponseDelayMS))
 }
 
 func delayMediumEventPredicate(currentState endpointProcessingState) bool { return true }
-func (m *Manager) delayMediumEventAction(previousState endpointProcessingState, sender ClientSender) (interface{}, endpointProcessingState) {
-	return m.imparimentHandler(previousState, sender, mediumResponseDelayMS)
+func (m *Manager) delayMediumEventAction(previousState endpointProcessingState, ep *managedEndpoint) (interface{}, endpointProcessingState) {
+	return m.imparimentHandler(previousState, ep, fixedDelay(mediumResponseDelayMS))
 }
 
 func delayLongEventPredicate(currentState endpointProcessingState) bool { return true }
-func (m *Manager) delayLongEventAction(previousState endpointProcessingState, sender ClientSender) (interface{}, endpointProcessingState) {
-	return m.imparimentHandler(previousState, sender, longResponseDelayMS)
+func (m *Manager) delayLongEventAction(previousState endpointProcessingState, ep *managedEndpoint) (interface{}, endpointProcessingState) {
+	return m.imparimentHandler(previousState, ep, fixedDelay(longResponseDelayMS))
 }
 
 func delayStopRespondingEventPredicate(currentState endpointProcessingState) bool { return true }
-func (m *Manager) delayStopRespondingEventAction(previousState endpointProcessingState, sender ClientSender) (interface{}, endpointProcessingState) {
-	return m.imparimentHandler(previousState, sender, stopRespondingMS)
+func (m *Manager) delayStopRespondingEventAction(previousState endpointProcessingState, ep *managedEndpoint) (interface{}, endpointProcessingState) {
+	return m.imparimentHandler(previousState, ep, fixedDelay(stopRespondingMS))
 }
 
 func delayStartRespondingEventPredicate(currentState endpointProcessingState) bool { return true }
-func (m *Manager) delayStartRespondingEventAction(previousState endpointProcessingState, sender ClientSender) (interface{}, endpointProcessingState) {
-	return m.imparimentHandler(previousState, sender, noResponseDelayMS)
+func (m *Manager) delayStartRespondingEventAction(previousState endpointProcessingState, ep *managedEndpoint) (interface{}, endpointProcessingState) {
+	return m.imparimentHandler(previousState, ep, fixedDelay(noResponseDelayMS))
+}
+
+func impairmentProfileEventPredicate(currentState endpointProcessingState) bool { return true }
+
+// impairmentProfileEventHandler builds the handler for whichever configured profile the event names.
+func (m *Manager) impairmentProfileEventHandler(e fmt.Stringer) (eventHandler, bool) {
+	profileEvent, ok := e.(event.ImpairmentProfileEvent)
+	if !ok {
+		return eventHandler{}, false
+	}
+	profile := m.profile(profileEvent.Profile)
+	if profile == nil {
+		return eventHandler{}, false
+	}
+	return eventHandler{impairmentProfileEventPredicate, func(previousState endpointProcessingState, ep *managedEndpoint) (interface{}, endpointProcessingState) {
+		return m.imparimentHandler(previousState, ep, profileDelay(profile))
+	}}, true
 }
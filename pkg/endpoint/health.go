@@ -0,0 +1,41 @@
+package endpoint
+
+import (
+	"fmt"
+
+	"endpoint-visualiser-server/pkg/health"
+)
+
+// Live is whether the router is still passing events on to the endpoint processors.
+func (m *Manager) Live() health.Status {
+	if !m.routerRunning() {
+		return health.Down("event router not running")
+	}
+	return health.Up("event router running")
+}
+
+// Ready is whether Start has started every endpoint's processor and events can reach them.
+func (m *Manager) Ready() health.Status {
+	if !m.started.Load() {
+		return health.Down("endpoint processors not started")
+	}
+	if !m.routerRunning() {
+		return health.Down("event router not running")
+	}
+	m.statusLock.RLock()
+	processors := len(m.statuses)
+	m.statusLock.RUnlock()
+	return health.Up(fmt.Sprintf("%d endpoint processors started", processors))
+}
+
+func (m *Manager) routerRunning() bool {
+	if !m.started.Load() {
+		return false
+	}
+	select {
+	case <-m.routerDone:
+		return false
+	default:
+		return true
+	}
+}
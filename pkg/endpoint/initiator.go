@@ -1,11 +1,14 @@
 package endpoint
 
 import (
+	"fmt"
 	"math/rand"
+	"sync"
 	"time"
-)
 
-type characterGenerator func() (string, func() int)
+	"endpoint-visualiser-server/pkg/logging"
+	"endpoint-visualiser-server/pkg/metrics"
+)
 
 const (
 	noResponseDelayMS     int = 0
@@ -20,76 +23,231 @@ const (
 	maxWaitForNextMessageMS int = 2000
 )
 
-func heartBeatGenerator() (character string, delayFunc func() int) {
-	return "❤️", func() int { return heartbeatIntervalMS }
+// controlStructures belong to a single run of trafficInitiator for a single endpoint.
+type controlStructures struct {
+	stopChan            chan struct{}
+	changeBehaviourChan chan responseBehaviour
+	doneChan            chan struct{} // closed when the initiator exits
+	requestSeq          *uint64       // The endpoint's, so sequence numbers carry on from run to run.
+	tally               *trafficTally // Also the endpoint's, nil for heartbeats.
 }
 
-func randomMessageGenerator() (character string, delayFunc func() int) {
-	genRand := func(min, max int) int { return rand.Intn(max-min) + min }
-	messages := []string{"🐷", "🐤", "🏈", "⚽", "🍋", "🍌"}
-	nextMessageDelayFunc := func() int {
-		return genRand(0, maxWaitForNextMessageMS)
+// startTraffic replaces whatever traffic the endpoint is currently generating.
+func (m *Manager) startTraffic(ep *managedEndpoint, generator Generator, behaviour responseBehaviour) {
+	m.stopTraffic(ep)
+	rng, tally := ep.trafficRng, &ep.tally
+	if _, isHeartbeat := generator.(heartbeatGenerator); isHeartbeat {
+		rng, tally = ep.heartbeatRng, nil
+	}
+	ep.cntl = &controlStructures{
+		stopChan:            make(chan struct{}),
+		changeBehaviourChan: make(chan responseBehaviour),
+		doneChan:            make(chan struct{}),
+		requestSeq:          &ep.requestSeq,
+		tally:               tally,
 	}
+	go m.trafficInitiator(ep.config.ID, ep.sender, ep.pool, &ep.inFlight, ep.cntl, rng, generator, behaviour)
+}
 
-	return messages[genRand(0, len(messages))], nextMessageDelayFunc
+// stopTraffic blocks until the endpoint's initiator (if any) has exited.
+func (m *Manager) stopTraffic(ep *managedEndpoint) {
+	if ep.cntl == nil {
+		return
+	}
+	close(ep.cntl.stopChan)
+	<-ep.cntl.doneChan
+	ep.cntl = nil
 }
 
-func (m *Manager) trafficInitiator(sender ClientSender, generateCharacter characterGenerator) {
+func (m *Manager) changeBehaviour(ep *managedEndpoint, behaviour responseBehaviour) {
+	if ep.cntl == nil {
+		return
+	}
+	select {
+	case ep.cntl.changeBehaviourChan <- behaviour:
+	case <-ep.cntl.doneChan: // Initiator gave up on its own, nothing to tell.
+	}
+}
 
-	responseDelay := noResponseDelayMS
+// trafficInitiator makes every random choice for the endpoint's traffic itself, in order, so a
+// given seed always produces the same traffic.
+func (m *Manager) trafficInitiator(id int, sender ClientSender, pool *connectionPool, inFlight *sync.WaitGroup, cntl *controlStructures, rng *rand.Rand, generator Generator, behaviour responseBehaviour) {
+	defer close(cntl.doneChan)
+
+	errChan := make(chan error, 1)
+	nextMessageTimer := m.clock.NewTimer(0)
+	defer nextMessageTimer.Stop()
+	brownout := newBrownoutCycle(m.clock, behaviour.failures)
+	defer brownout.stop()
+
+	// Heartbeats keep their own pace whatever the target rate.
+	_, isHeartbeat := generator.(heartbeatGenerator)
+	targetTPS := func() float64 {
+		if isHeartbeat {
+			return 0
+		}
+		return behaviour.targetTPS
+	}
+	pace := newPacer(targetTPS(), m.clock.Now())
 
-goRoutineLoop:
 	for {
 		select {
-		case <-m.cntl.stopChan:
-			break goRoutineLoop
-		case responseDelay = <-m.cntl.changeDelayChan:
-			continue
-		default:
-			char, getNextMessageDelay := generateCharacter()
-			errChan := make(chan error)
-			go sendMessage(sender, errChan, char, responseDelay)
-			nextMessageTimer := time.NewTimer(time.Duration(getNextMessageDelay()) * time.Millisecond)
-			select {
-			case <-nextMessageTimer.C:
-				continue
-			case <-m.cntl.stopChan:
-				break goRoutineLoop
-			case responseDelay = <-m.cntl.changeDelayChan:
+		case <-cntl.stopChan:
+			return
+		case behaviour = <-cntl.changeBehaviourChan:
+			if behaviour.failures.brownoutChanged(brownout.failures) {
+				brownout.stop()
+				brownout = newBrownoutCycle(m.clock, behaviour.failures)
+				m.sendBrownout(id, sender, false)
+			}
+			if targetTPS() != pace.tps {
+				now := m.clock.Now()
+				pace.setTarget(targetTPS(), now)
+				if pace.paced() {
+					nextMessageTimer.Reset(pace.wait(now))
+				}
+			}
+		case <-brownout.timerChan():
+			m.sendBrownout(id, sender, brownout.toggle())
+		case <-nextMessageTimer.C():
+			now := m.clock.Now()
+			char, wait := generator.Next(rng, now)
+			if pace.paced() {
+				wait = pace.wait(now)
+			}
+			response := behaviour.planResponse(rng, brownout.isActive())
+			nextMessageTimer.Reset(wait)
+			// Checked here rather than by sendMessage, so an exhausted pool costs nothing per tick.
+			if !pool.tryAcquire() {
+				m.metrics.RequestsRejected.Inc(metrics.Endpoint(id))
 				continue
-			case err := <-errChan:
-				m.logger.Printf("\n%s", err.Error())
-				break goRoutineLoop
 			}
+			*cntl.requestSeq++
+			request := plannedRequest{*cntl.requestSeq, char, response}
+			inFlight.Add(1)
+			go func() {
+				defer inFlight.Done()
+				m.sendMessage(id, sender, pool, errChan, cntl.tally, request)
+			}()
+		case err := <-errChan:
+			m.logger.Warn("Traffic stopped, couldn't reach clients", logging.EndpointID, id, logging.Err, err)
+			return
 		}
 	}
-	return
 }
 
+// plannedRequest is a request as the initiator decided it, before it's sent.
+type plannedRequest struct {
+	seq       uint64
+	character string
+	response  plannedResponse
+}
+
+// TrafficMessage is a request, or its response or error. CorrelationID pairs them up: it's
+// unique to the request for the life of the server. Requests that are never answered have no
+// response, the client can tell by their correlation IDs.
 type TrafficMessage struct {
-	ID        string `json:"id"`
-	Character string `json:"character"`
+	ID             string     `json:"id"`
+	Character      string     `json:"character"`
+	CorrelationID  string     `json:"correlationId"`
+	Seq            uint64     `json:"seq"` // Counts the endpoint's requests, from 1.
+	RequestSentAt  time.Time  `json:"requestSentAt"`
+	ResponseSentAt *time.Time `json:"responseSentAt,omitempty"`
+	Pool           *PoolStats `json:"pool,omitempty"`
 }
 
-const clientRenderLatencyMS int = 400
+func correlationID(endpointID int, seq uint64) string {
+	return fmt.Sprintf("%d-%d", endpointID, seq)
+}
 
-func sendMessage(clientSender ClientSender, errChan chan<- error, char string, responseDelay int) {
+const clientRenderLatencyMS int = 400
 
-	request := TrafficMessage{ID: "TrafficRequest", Character: char}
+// sendMessage holds the connection the initiator acquired for it until the request has been
+// answered. Requests that are never answered hold it until they time out. Closing the pool, on
+// disconnect or shutdown, abandons the response. Stopping traffic doesn't, as that only swaps
+// traffic for heartbeats and the requests already sent still deserve their responses.
+func (m *Manager) sendMessage(id int, clientSender ClientSender, pool *connectionPool, errChan chan<- error, tally *trafficTally, planned plannedRequest) {
+
+	stats := pool.stats()
+	request := TrafficMessage{
+		ID:            "TrafficRequest",
+		Character:     planned.character,
+		CorrelationID: correlationID(id, planned.seq),
+		Seq:           planned.seq,
+		RequestSentAt: m.clock.Now(),
+		Pool:          &stats,
+	}
 	if err := clientSender(request); err != nil {
-		errChan <- err
+		pool.release()
+		reportError(errChan, err)
+		return
+	}
+	tally.requestSent()
+	endpoint := metrics.Endpoint(id)
+	m.metrics.RequestsSent.Inc(endpoint)
+
+	outcome, delayMS := planned.response.outcome, planned.response.delayMS
+	if outcome == outcomeDrop {
+		reason := metrics.ReasonDropped
+		if planned.response.stoppedResponding {
+			reason = metrics.ReasonStopResponding
+		}
+		m.metrics.RequestsUnanswered.Inc(endpoint, reason)
+		m.holdUntilTimeout(pool)
+		pool.release()
+		tally.abandoned()
+		return
+	}
+	m.metrics.ResponseLatency.Observe(float64(delayMS)/1000, endpoint)
+
+	responseTimer := m.clock.NewTimer(time.Duration(delayMS+clientRenderLatencyMS) * time.Millisecond)
+	defer responseTimer.Stop()
+	select {
+	case <-responseTimer.C():
+	case <-pool.closed:
+		pool.release()
+		m.metrics.RequestsUnanswered.Inc(endpoint, metrics.ReasonDisconnected)
+		tally.abandoned()
 		return
 	}
+	pool.release() // Before the reply, so it reports the pool clients will see next.
+
+	reply := request
+	reply.ID = "TrafficResponse"
+	respondedAt := m.clock.Now()
+	reply.ResponseSentAt = &respondedAt
+	if outcome == outcomeError {
+		reply.ID = "TrafficError"
+	}
+	released := pool.stats()
+	reply.Pool = &released
+	// Tallied first, so stats never show a response clients already have as outstanding.
+	tally.responseSent(respondedAt, delayMS)
+	if err := clientSender(reply); err != nil {
+		tally.responseUnsent(respondedAt, delayMS)
+		reportError(errChan, err)
+		return
+	}
+	if outcome == outcomeError {
+		m.metrics.ResponsesSent.Inc(endpoint, metrics.OutcomeError)
+	} else {
+		m.metrics.ResponsesSent.Inc(endpoint, metrics.OutcomeResponse)
+	}
+}
 
-	if responseDelay != stopRespondingMS {
-		responseDelay += clientRenderLatencyMS
-		responseTimer := time.NewTimer((time.Duration(responseDelay) * time.Millisecond))
-		<-responseTimer.C
-		response := TrafficMessage{ID: "TrafficResponse", Character: char}
+func (m *Manager) holdUntilTimeout(pool *connectionPool) {
+	timeout := m.clock.NewTimer(time.Duration(requestTimeoutMS) * time.Millisecond)
+	defer timeout.Stop()
+	select {
+	case <-timeout.C():
+	case <-pool.closed:
+	}
+}
 
-		if err := clientSender(response); err != nil {
-			errChan <- err
-			return
-		}
+// reportError never blocks, the initiator only needs to hear about one failure.
+func reportError(errChan chan<- error, err error) {
+	select {
+	case errChan <- err:
+	default:
 	}
 }
@@ -0,0 +1,185 @@
+package endpoint
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// ImpairmentProfile describes how long an impaired endpoint takes to respond, sampled
+// afresh for every request. Which fields are used depends on the Distribution:
+//
+//	uniform:   MinMS, MaxMS
+//	normal:    MeanMS, StdDevMS
+//	lognormal: MedianMS, Sigma (the standard deviation of ln(latency))
+//	pareto:    ScaleMS (the minimum latency), Shape
+//	empirical: Percentiles, interpolated linearly
+//
+// MaxMS caps every distribution, and is the upper bound for uniform.
+type ImpairmentProfile struct {
+	Name         string            `json:"name"`
+	Distribution string            `json:"distribution"`
+	MinMS        float64           `json:"minMS,omitempty"`
+	MaxMS        float64           `json:"maxMS,omitempty"`
+	MeanMS       float64           `json:"meanMS,omitempty"`
+	StdDevMS     float64           `json:"stdDevMS,omitempty"`
+	MedianMS     float64           `json:"medianMS,omitempty"`
+	Sigma        float64           `json:"sigma,omitempty"`
+	ScaleMS      float64           `json:"scaleMS,omitempty"`
+	Shape        float64           `json:"shape,omitempty"`
+	Percentiles  []PercentilePoint `json:"percentiles,omitempty"`
+}
+
+type PercentilePoint struct {
+	Percentile float64 `json:"p"`
+	LatencyMS  float64 `json:"ms"`
+}
+
+const (
+	uniformDistribution   = "uniform"
+	normalDistribution    = "normal"
+	logNormalDistribution = "lognormal"
+	paretoDistribution    = "pareto"
+	empiricalDistribution = "empirical"
+)
+
+// Validate reports the first thing wrong with the profile, if anything.
+func (p ImpairmentProfile) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("impairment profile has no name")
+	}
+	if p.MaxMS < 0 {
+		return fmt.Errorf("impairment profile %s: maxMS must not be negative", p.Name)
+	}
+
+	switch p.Distribution {
+	case uniformDistribution:
+		if p.MinMS < 0 || p.MaxMS <= p.MinMS {
+			return fmt.Errorf("impairment profile %s: uniform needs 0 <= minMS < maxMS", p.Name)
+		}
+	case normalDistribution:
+		if p.MeanMS < 0 || p.StdDevMS <= 0 {
+			return fmt.Errorf("impairment profile %s: normal needs meanMS >= 0 and stdDevMS > 0", p.Name)
+		}
+	case logNormalDistribution:
+		if p.MedianMS <= 0 || p.Sigma <= 0 {
+			return fmt.Errorf("impairment profile %s: lognormal needs medianMS > 0 and sigma > 0", p.Name)
+		}
+	case paretoDistribution:
+		if p.ScaleMS <= 0 || p.Shape <= 0 {
+			return fmt.Errorf("impairment profile %s: pareto needs scaleMS > 0 and shape > 0", p.Name)
+		}
+	case empiricalDistribution:
+		if len(p.Percentiles) < 2 {
+			return fmt.Errorf("impairment profile %s: empirical needs at least two percentiles", p.Name)
+		}
+		for i, point := range p.Percentiles {
+			if point.Percentile < 0 || point.Percentile > 100 || point.LatencyMS < 0 {
+				return fmt.Errorf("impairment profile %s: percentile %d must have 0 <= p <= 100 and ms >= 0", p.Name, i)
+			}
+			if i > 0 && (point.Percentile <= p.Percentiles[i-1].Percentile || point.LatencyMS < p.Percentiles[i-1].LatencyMS) {
+				return fmt.Errorf("impairment profile %s: percentiles must be increasing", p.Name)
+			}
+		}
+	default:
+		return fmt.Errorf("impairment profile %s: unknown distribution %q", p.Name, p.Distribution)
+	}
+	return nil
+}
+
+// sample draws a single response delay from the profile.
+func (p *ImpairmentProfile) sample(rng *rand.Rand) int {
+	var ms float64
+	switch p.Distribution {
+	case uniformDistribution:
+		ms = p.MinMS + rng.Float64()*(p.MaxMS-p.MinMS)
+	case normalDistribution:
+		ms = p.MeanMS + rng.NormFloat64()*p.StdDevMS
+	case logNormalDistribution:
+		ms = p.MedianMS * math.Exp(rng.NormFloat64()*p.Sigma)
+	case paretoDistribution:
+		ms = p.ScaleMS / math.Pow(1-rng.Float64(), 1/p.Shape)
+	case empiricalDistribution:
+		ms = p.percentile(rng.Float64() * 100)
+	}
+	return p.clamp(ms)
+}
+
+// nominal is the profile's typical (median, or mean for normal) delay, used to describe it to clients.
+func (p *ImpairmentProfile) nominal() int {
+	var ms float64
+	switch p.Distribution {
+	case uniformDistribution:
+		ms = (p.MinMS + p.MaxMS) / 2
+	case normalDistribution:
+		ms = p.MeanMS
+	case logNormalDistribution:
+		ms = p.MedianMS
+	case paretoDistribution:
+		ms = p.ScaleMS * math.Pow(2, 1/p.Shape)
+	case empiricalDistribution:
+		ms = p.percentile(50)
+	}
+	return p.clamp(ms)
+}
+
+func (p *ImpairmentProfile) percentile(pc float64) float64 {
+	points := p.Percentiles
+	i := sort.Search(len(points), func(i int) bool { return points[i].Percentile >= pc })
+	switch {
+	case i == 0:
+		return points[0].LatencyMS
+	case i == len(points):
+		return points[len(points)-1].LatencyMS
+	}
+	lo, hi := points[i-1], points[i]
+	fraction := (pc - lo.Percentile) / (hi.Percentile - lo.Percentile)
+	return lo.LatencyMS + fraction*(hi.LatencyMS-lo.LatencyMS)
+}
+
+func (p *ImpairmentProfile) clamp(ms float64) int {
+	if ms < 0 {
+		ms = 0
+	}
+	if p.MaxMS > 0 && ms > p.MaxMS {
+		ms = p.MaxMS
+	}
+	return int(ms)
+}
+
+// responseDelay is how an endpoint is currently responding, either a fixed delay
+// (including stopRespondingMS) or one sampled from an impairment profile.
+type responseDelay struct {
+	fixedMS int
+	profile *ImpairmentProfile
+}
+
+func fixedDelay(ms int) responseDelay {
+	return responseDelay{fixedMS: ms}
+}
+
+func profileDelay(profile *ImpairmentProfile) responseDelay {
+	return responseDelay{profile: profile}
+}
+
+func (d responseDelay) nextMS(rng *rand.Rand) int {
+	if d.profile != nil {
+		return d.profile.sample(rng)
+	}
+	return d.fixedMS
+}
+
+func (d responseDelay) nominalMS() int {
+	if d.profile != nil {
+		return d.profile.nominal()
+	}
+	return d.fixedMS
+}
+
+func (d responseDelay) profileName() string {
+	if d.profile != nil {
+		return d.profile.Name
+	}
+	return ""
+}
@@ -0,0 +1,91 @@
+package endpoint
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestImpairmentProfileSampling(t *testing.T) {
+
+	profiles := []ImpairmentProfile{
+		{Name: "uniform", Distribution: "uniform", MinMS: 100, MaxMS: 300},
+		{Name: "normal", Distribution: "normal", MeanMS: 800, StdDevMS: 100},
+		{Name: "lognormal", Distribution: "lognormal", MedianMS: 400, Sigma: 0.5},
+		{Name: "pareto", Distribution: "pareto", ScaleMS: 200, Shape: 2, MaxMS: 5000},
+		{Name: "empirical", Distribution: "empirical", Percentiles: []PercentilePoint{{0, 100}, {50, 200}, {90, 400}, {100, 1000}}},
+	}
+
+	const numSamples = 20000
+	rng := rand.New(rand.NewSource(1))
+	for _, profile := range profiles {
+		if err := profile.Validate(); err != nil {
+			t.Fatalf("%s: %s", profile.Name, err)
+		}
+
+		samples := make([]int, numSamples)
+		for i := range samples {
+			samples[i] = profile.sample(rng)
+		}
+		sort.Ints(samples)
+
+		median, nominal := float64(samples[numSamples/2]), float64(profile.nominal())
+		if math.Abs(median-nominal) > nominal*0.05 {
+			t.Errorf("%s: sampled median %.0f too far from nominal %.0f", profile.Name, median, nominal)
+		}
+		if samples[0] < 0 || (profile.MaxMS > 0 && float64(samples[numSamples-1]) > profile.MaxMS) {
+			t.Errorf("%s: samples out of bounds [%d, %d]", profile.Name, samples[0], samples[numSamples-1])
+		}
+	}
+}
+
+func TestImpairmentProfileValidation(t *testing.T) {
+
+	invalid := []ImpairmentProfile{
+		{Distribution: "uniform", MinMS: 1, MaxMS: 2},
+		{Name: "unknown", Distribution: "gamma"},
+		{Name: "uniform", Distribution: "uniform", MinMS: 300, MaxMS: 100},
+		{Name: "normal", Distribution: "normal", MeanMS: 800},
+		{Name: "pareto", Distribution: "pareto", ScaleMS: 200},
+		{Name: "empirical", Distribution: "empirical", Percentiles: []PercentilePoint{{50, 200}, {10, 100}}},
+	}
+	for _, profile := range invalid {
+		if err := profile.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", profile)
+		}
+	}
+}
+
+func TestFailureModeOutcomes(t *testing.T) {
+
+	rng := rand.New(rand.NewSource(1))
+	base := responseBehaviour{delay: fixedDelay(shortResponseDelayMS)}
+
+	dropAll := base
+	dropAll.failures.DropPercent = 100
+	errorAll := base
+	errorAll.failures.ErrorPercent = 100
+	jittery := base
+	jittery.failures.JitterMS = 100
+
+	for i := 0; i < 1000; i++ {
+		if outcome, _ := dropAll.nextResponse(rng, false); outcome != outcomeDrop {
+			t.Fatalf("expected every response to be dropped")
+		}
+		if outcome, _ := errorAll.nextResponse(rng, false); outcome != outcomeError {
+			t.Fatalf("expected every response to be an error")
+		}
+		if _, delayMS := jittery.nextResponse(rng, false); delayMS < shortResponseDelayMS-100 || delayMS > shortResponseDelayMS+100 {
+			t.Fatalf("jittered delay %d out of range", delayMS)
+		}
+		if outcome, delayMS := base.nextResponse(rng, true); outcome != outcomeRespond || delayMS != longResponseDelayMS {
+			t.Fatalf("expected a slow response during brownout, got %d after %dms", outcome, delayMS)
+		}
+	}
+
+	stopped := responseBehaviour{delay: fixedDelay(stopRespondingMS)}
+	if outcome, _ := stopped.nextResponse(rng, false); outcome != outcomeDrop {
+		t.Fatalf("expected no response when stopped responding")
+	}
+}
@@ -1,33 +1,59 @@
 package endpoint
 
 import (
-	"endpoint-visualiser-server/pkg/clienthandler/websocket"
+	"context"
 	"endpoint-visualiser-server/pkg/event"
-	"io/ioutil"
-	"log"
+	"fmt"
+	"math/rand"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"endpoint-visualiser-server/pkg/clock"
+	"endpoint-visualiser-server/pkg/journal"
+	"endpoint-visualiser-server/pkg/logging"
+	"endpoint-visualiser-server/pkg/metrics"
 )
 
 type Manager struct {
 	config           []ManagableEndpoint
-	websocketManager *websocket.Manager
+	websocketManager ClientSenderProvider
 	eventInChan      <-chan event.Event
-	logger           *log.Logger
-	cntl             controlStructures
+	logger           logging.Logger
+	metrics          *metrics.Metrics
+	journal          *journal.Journal // nil unless journalling.
 	handlerMap       map[string]eventHandler
+	factoryMap       map[string]handlerFactory // For events carrying an argument, by event.Kind.
+	profileLock      sync.RWMutex
+	profiles         map[string]*ImpairmentProfile
+	reconfigureChan  chan []ManagableEndpoint
+	reseedChan       chan int64
+	seed             int64
+	newSource        func(seed int64) rand.Source
+	clock            clock.Clock
+	statsInterval    time.Duration
+	routerDone       chan struct{}
+	started          atomic.Bool  // Set once Start has started the processors and router.
+	statusLock       sync.RWMutex // Also guards config once started.
+	statuses         map[int]EndpointStatus
+	pools            map[int]*connectionPool
+	processors       sync.WaitGroup
+	finished         map[int]chan struct{} // Closed when an endpoint's latest processor exits. Router owned.
 }
 
-type controlStructures struct {
-	stopChan        chan struct{}
-	changeDelayChan chan int
+// ClientSenderProvider hands out a sender for the clients watching a given endpoint.
+// *websocket.Manager is the production implementation.
+type ClientSenderProvider interface {
+	GetSingleRequestSender(id int) func(interface{}) error
 }
 
 type ManagerOption func(*Manager)
 
 type ManagableEndpoint struct {
-	ID       int    `json:"id"`
-	Title    string `json:"title"`
-	MaxConns int    `json:"maxConns"`
+	ID        int             `json:"id"`
+	Title     string          `json:"title"`
+	MaxConns  int             `json:"maxConns"`
+	Generator GeneratorConfig `json:"generator"` // Used from the next StartTrafficEvent.
 }
 
 func WithConfig(config []ManagableEndpoint) ManagerOption {
@@ -36,33 +62,94 @@ func WithConfig(config []ManagableEndpoint) ManagerOption {
 	}
 }
 
-func WithLogger(l *log.Logger) ManagerOption {
+// WithImpairmentProfiles makes each profile available as an ImpairmentProfileEvent.
+// Profiles are expected to have passed Validate.
+func WithImpairmentProfiles(profiles []ImpairmentProfile) ManagerOption {
+	return func(m *Manager) {
+		m.setProfiles(profiles)
+	}
+}
+
+func WithLogger(l logging.Logger) ManagerOption {
 	return func(m *Manager) {
 		m.logger = l
 	}
 }
 
-func WithWebSocketTarget(target *websocket.Manager) ManagerOption {
+// WithMetrics records traffic and endpoint state, see metrics.Metrics.
+func WithMetrics(mx *metrics.Metrics) ManagerOption {
+	return func(m *Manager) {
+		m.metrics = mx
+	}
+}
+
+// WithJournal records every event routed, every state transition and every message sent to clients.
+func WithJournal(j *journal.Journal) ManagerOption {
+	return func(m *Manager) {
+		m.journal = j
+	}
+}
+
+// WithClock times traffic, responses and status by c rather than the wall clock.
+func WithClock(c clock.Clock) ManagerOption {
+	return func(m *Manager) {
+		m.clock = c
+	}
+}
+
+// WithRandSource supplies the source behind each endpoint's random choices, seeded as described
+// for WithSeed. The default is rand.NewSource.
+func WithRandSource(newSource func(seed int64) rand.Source) ManagerOption {
+	return func(m *Manager) {
+		m.newSource = newSource
+	}
+}
+
+// WithSeed makes traffic reproducible: the same seed and the same events give the same
+// sequence of messages. Without it, the seed is taken from the time.
+func WithSeed(seed int64) ManagerOption {
+	return func(m *Manager) {
+		m.seed = seed
+	}
+}
+
+// WithStatsInterval is how often each endpoint sends clients an EndpointStatsMessage, zero for
+// never. The default is every 5 seconds.
+func WithStatsInterval(d time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.statsInterval = d
+	}
+}
+
+func WithWebSocketTarget(target ClientSenderProvider) ManagerOption {
 	return func(m *Manager) {
 		m.websocketManager = target
 	}
 }
 
 func NewManager(eventChan <-chan event.Event, opts ...ManagerOption) *Manager {
-	defaultDiscardLogger := log.New(ioutil.Discard, "", 0)
 	manager := &Manager{
 		eventInChan: eventChan,
-		cntl: controlStructures{
-			stopChan:        make(chan struct{}),
-			changeDelayChan: make(chan int),
-		},
-		logger: defaultDiscardLogger,
-	}
-	manager.setupHandlerMap()
+		logger:      logging.Discard(),
+		metrics:     metrics.New(),
+		statuses:    make(map[int]EndpointStatus),
+		pools:       make(map[int]*connectionPool),
+		profiles:    make(map[string]*ImpairmentProfile),
 
+		reconfigureChan: make(chan []ManagableEndpoint),
+		reseedChan:      make(chan int64),
+		seed:            time.Now().UnixNano(),
+		newSource:       rand.NewSource,
+		clock:           clock.Real(),
+		statsInterval:   defaultStatsInterval,
+		routerDone:      make(chan struct{}),
+		finished:        make(map[int]chan struct{}),
+	}
 	for _, opt := range opts {
 		opt(manager)
 	}
+
+	manager.setupHandlerMap()
 	return manager
 }
 
@@ -77,33 +164,134 @@ func (m *Manager) setupHandlerMap() {
 	handlerMap[event.DelayLongEvent{}.String()] = eventHandler{delayLongEventPredicate, m.delayLongEventAction}
 	handlerMap[event.StopRespondingEvent{}.String()] = eventHandler{delayStopRespondingEventPredicate, m.delayStopRespondingEventAction}
 	handlerMap[event.StartRespondingEvent{}.String()] = eventHandler{delayStartRespondingEventPredicate, m.delayStartRespondingEventAction}
+	handlerMap[event.ClearFailuresEvent{}.String()] = eventHandler{failureModeEventPredicate, m.clearFailuresEventAction}
+	handlerMap[event.RaiseTPSEvent{}.String()] = eventHandler{tpsEventPredicate, m.raiseTPSEventAction}
+	handlerMap[event.LowerTPSEvent{}.String()] = eventHandler{tpsEventPredicate, m.lowerTPSEventAction}
 	m.handlerMap = handlerMap
+
+	factoryMap := make(map[string]handlerFactory)
+	factoryMap[event.Kind(event.DropResponsesEvent{})] = m.failureModeEventHandler
+	factoryMap[event.Kind(event.ErrorResponsesEvent{})] = m.failureModeEventHandler
+	factoryMap[event.Kind(event.JitterEvent{})] = m.failureModeEventHandler
+	factoryMap[event.Kind(event.BrownoutEvent{})] = m.failureModeEventHandler
+	factoryMap[event.Kind(event.ImpairmentProfileEvent{})] = m.impairmentProfileEventHandler
+	factoryMap[event.Kind(event.TargetTPSEvent{})] = m.targetTPSEventHandler
+	m.factoryMap = factoryMap
 	return
 }
 
-func (m *Manager) Start(synchStart *sync.WaitGroup) {
+func (m *Manager) handlerFor(e fmt.Stringer) (eventHandler, bool) {
+	if handler, ok := m.handlerMap[e.String()]; ok {
+		return handler, true
+	}
+	if factory, ok := m.factoryMap[event.Kind(e)]; ok {
+		return factory(e)
+	}
+	return eventHandler{}, false
+}
+
+// Start runs a processor for every endpoint plus the event router. Cancelling ctx shuts them
+// all down, see Wait.
+func (m *Manager) Start(ctx context.Context, synchStart *sync.WaitGroup) {
 	synchStart.Add(len(m.config) + 1) //  One for each endpoint and the router
 	routingMap := make(map[int]chan<- interface{})
 
 	for _, endpoint := range m.config {
-		endpointEventInChan := make(chan interface{})
-		routingMap[endpoint.ID] = endpointEventInChan
-		go m.endpointProcessor(endpoint, endpointEventInChan)
+		routingMap[endpoint.ID] = m.startProcessor(endpoint)
 		synchStart.Done()
 	}
 
-	go m.routeEvents(m.eventInChan, routingMap)
+	m.journal.RecordSeed(m.seed)
+	m.started.Store(true)
+	go m.routeEvents(ctx, m.eventInChan, routingMap)
 	synchStart.Done()
 }
 
-func (m *Manager) routeEvents(inChan <-chan event.Event, routeMap map[int]chan<- interface{}) {
-	for e := range inChan {
-		m.logger.Printf("\nEndpoint Manager Router Recevived event %T on inputChan, sending to endpoint %d", e.Event, e.Destination)
+// startProcessor first waits for any processor the endpoint had before to finish, so the old
+// one can't forget the new one's status.
+func (m *Manager) startProcessor(endpoint ManagableEndpoint) chan<- interface{} {
+	if finished, ok := m.finished[endpoint.ID]; ok {
+		<-finished
+	}
+	endpointEventInChan := make(chan interface{})
+	finished := make(chan struct{})
+	m.finished[endpoint.ID] = finished
+	m.publishStatus(endpoint.ID, initialProcessingState(), nil, "")
+	m.processors.Add(1)
+	seed := m.seed
+	go func() {
+		defer close(finished)
+		m.endpointProcessor(endpoint, seed, endpointEventInChan)
+	}()
+	return endpointEventInChan
+}
+
+// Wait blocks until every endpoint processor has drained its in-flight traffic and told its
+// clients it's going away, which starts once Start's context is cancelled.
+func (m *Manager) Wait(ctx context.Context) error {
+	drained := make(chan struct{})
+	go func() {
+		m.processors.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Manager) routeEvents(ctx context.Context, inChan <-chan event.Event, routeMap map[int]chan<- interface{}) {
+	defer func() {
+		m.logger.Info("Endpoint router shutting down")
+		for _, routeChan := range routeMap {
+			close(routeChan)
+		}
+		close(m.routerDone)
+	}()
+
+	var statsTimer clock.Timer
+	var statsDue <-chan time.Time // Never fires if stats are off.
+	if m.statsInterval > 0 {
+		statsTimer = m.clock.NewTimer(m.statsInterval)
+		defer statsTimer.Stop()
+		statsDue = statsTimer.C()
+	}
+
+	for {
+		var e event.Event
+		select {
+		case <-ctx.Done():
+			return
+		case config := <-m.reconfigureChan:
+			m.applyConfig(config, routeMap)
+			continue
+		case seed := <-m.reseedChan:
+			m.applySeed(seed, routeMap)
+			continue
+		case <-statsDue:
+			for _, routeChan := range routeMap {
+				routeChan <- statsTick{}
+			}
+			statsTimer.Reset(m.statsInterval)
+			continue
+		case received, ok := <-inChan:
+			if !ok {
+				m.logger.Info("Event channel closed")
+				return
+			}
+			e = received
+		}
+		m.journal.RecordEvent(e)
+		m.logger.Debug("Routing event", logging.EndpointID, e.Destination, logging.Event, e.String())
 
 		if routeChan := routeMap[e.Destination]; routeChan != nil {
 			routeChan <- e
 			continue
 		}
-		m.logger.Printf("\nYou cannot send messages to endpoint %d, it doesn't exist in your config!", e.Destination)
+		m.logger.Warn("Event for an endpoint that isn't configured", logging.EndpointID, e.Destination, logging.Event, e.String())
+		e.Reply(event.ErrUnknownDestination)
 	}
 }
@@ -0,0 +1,96 @@
+package endpoint
+
+import (
+	"sync"
+)
+
+const (
+	defaultMaxConns  int = 16
+	requestTimeoutMS int = 10000 // How long a request that never gets a response holds its connection.
+)
+
+// PoolStats describe an endpoint's simulated connection pool at a point in time.
+type PoolStats struct {
+	Size     int `json:"size"`
+	Active   int `json:"active"`
+	Idle     int `json:"idle"`
+	Rejected int `json:"rejected"` // Requests turned away since connect, because every connection was busy.
+}
+
+// connectionPool models MaxConns logical connections to an endpoint. Every request holds a
+// connection until it's answered (or times out), so a slow endpoint exhausts the pool and
+// further requests are rejected until one is released.
+type connectionPool struct {
+	size     int
+	idle     chan struct{} // One token per idle connection.
+	closed   chan struct{}
+	lock     sync.Mutex
+	rejected int
+	once     sync.Once
+}
+
+func newConnectionPool(maxConns int) *connectionPool {
+	if maxConns <= 0 {
+		maxConns = defaultMaxConns
+	}
+	p := &connectionPool{
+		size:   maxConns,
+		idle:   make(chan struct{}, maxConns),
+		closed: make(chan struct{}),
+	}
+	for i := 0; i < maxConns; i++ {
+		p.idle <- struct{}{}
+	}
+	return p
+}
+
+// tryAcquire takes an idle connection if there is one, counting the request as rejected if
+// there isn't. A closed pool refuses everyone without counting them.
+func (p *connectionPool) tryAcquire() bool {
+	select {
+	case <-p.closed:
+		return false
+	default:
+	}
+	select {
+	case <-p.idle:
+		return true
+	default:
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.rejected++
+	return false
+}
+
+func (p *connectionPool) release() {
+	select {
+	case p.idle <- struct{}{}:
+	default: // Can't happen unless released twice, never grow the pool.
+	}
+}
+
+func (p *connectionPool) stats() PoolStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	idle := len(p.idle)
+	return PoolStats{Size: p.size, Active: p.size - idle, Idle: idle, Rejected: p.rejected}
+}
+
+// close abandons every request still holding a connection.
+func (p *connectionPool) close() {
+	p.once.Do(func() { close(p.closed) })
+}
+
+func (m *Manager) openPool(ep *managedEndpoint) {
+	m.closePool(ep)
+	ep.pool = newConnectionPool(ep.config.MaxConns)
+}
+
+func (m *Manager) closePool(ep *managedEndpoint) {
+	if ep.pool != nil {
+		ep.pool.close()
+		ep.pool = nil
+	}
+}
@@ -0,0 +1,42 @@
+package endpoint
+
+import (
+	"testing"
+)
+
+func TestConnectionPoolRejectsWhenExhausted(t *testing.T) {
+
+	pool := newConnectionPool(2)
+	if !pool.tryAcquire() || !pool.tryAcquire() {
+		t.Fatalf("expected both connections to be free")
+	}
+	if pool.tryAcquire() {
+		t.Fatalf("expected the exhausted pool to reject")
+	}
+	if stats := pool.stats(); stats != (PoolStats{Size: 2, Active: 2, Idle: 0, Rejected: 1}) {
+		t.Fatalf("unexpected pool stats %+v", stats)
+	}
+
+	pool.release()
+	if !pool.tryAcquire() {
+		t.Fatalf("expected the released connection to be free")
+	}
+}
+
+func TestConnectionPoolRefusesOnceClosed(t *testing.T) {
+
+	pool := newConnectionPool(2)
+	pool.close()
+	if pool.tryAcquire() {
+		t.Fatalf("acquire should fail once the pool is closed, even with idle connections")
+	}
+	if stats := pool.stats(); stats.Idle != 2 || stats.Rejected != 0 {
+		t.Fatalf("refused acquires shouldn't use up connections or count as rejected, got %+v", stats)
+	}
+}
+
+func TestConnectionPoolDefaultsSize(t *testing.T) {
+	if stats := newConnectionPool(0).stats(); stats.Size != defaultMaxConns || stats.Idle != defaultMaxConns {
+		t.Fatalf("unexpected pool stats %+v", stats)
+	}
+}
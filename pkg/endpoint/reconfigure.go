@@ -0,0 +1,122 @@
+package endpoint
+
+import (
+	"reflect"
+
+	"endpoint-visualiser-server/pkg/logging"
+)
+
+// Reconfigure applies a new set of endpoints and impairment profiles while running. New
+// endpoints get a processor and removed ones are disconnected and torn down. A changed
+// generator applies from the endpoint's next StartTrafficEvent, but a changed maxConns only
+// once it reconnects, see MustReconnect.
+func (m *Manager) Reconfigure(config []ManagableEndpoint, profiles []ImpairmentProfile) {
+	m.setProfiles(profiles)
+	select {
+	case m.reconfigureChan <- config:
+	case <-m.routerDone:
+	}
+}
+
+// MustReconnect lists the connected endpoints whose maxConns differs in config, which their
+// pools only pick up once they reconnect.
+func (m *Manager) MustReconnect(config []ManagableEndpoint) []int {
+	m.statusLock.RLock()
+	defer m.statusLock.RUnlock()
+	current := make(map[int]int, len(m.config))
+	for _, ep := range m.config {
+		current[ep.ID] = ep.MaxConns
+	}
+	var ids []int
+	for _, ep := range config {
+		maxConns, exists := current[ep.ID]
+		if exists && maxConns != ep.MaxConns && m.pools[ep.ID] != nil {
+			ids = append(ids, ep.ID)
+		}
+	}
+	return ids
+}
+
+// applyConfig runs on the router goroutine, which owns the routing map.
+func (m *Manager) applyConfig(config []ManagableEndpoint, routeMap map[int]chan<- interface{}) {
+	m.statusLock.RLock()
+	previous := make(map[int]ManagableEndpoint, len(m.config))
+	for _, ep := range m.config {
+		previous[ep.ID] = ep
+	}
+	m.statusLock.RUnlock()
+
+	wanted := make(map[int]bool, len(config))
+	for _, ep := range config {
+		wanted[ep.ID] = true
+		routeChan, exists := routeMap[ep.ID]
+		switch {
+		case !exists:
+			m.logger.Info("Adding endpoint", logging.EndpointID, ep.ID)
+			routeMap[ep.ID] = m.startProcessor(ep)
+		case !reflect.DeepEqual(previous[ep.ID], ep):
+			routeChan <- ep
+		}
+	}
+
+	for id, routeChan := range routeMap {
+		if !wanted[id] {
+			m.logger.Info("Removing endpoint", logging.EndpointID, id)
+			routeChan <- endpointRemoved{}
+			close(routeChan)
+			delete(routeMap, id)
+		}
+	}
+
+	m.statusLock.Lock()
+	m.config = config
+	m.statusLock.Unlock()
+}
+
+// Reseed restarts every endpoint's random sequences from seed, as though the manager had been
+// created WithSeed(seed). Endpoints already generating traffic restart it, so from every event
+// routed after Reseed returns, traffic is as it would be from a fresh manager.
+func (m *Manager) Reseed(seed int64) {
+	select {
+	case m.reseedChan <- seed:
+	case <-m.routerDone:
+	}
+}
+
+// Seed is what the manager's random sequences were last seeded with.
+func (m *Manager) Seed() int64 {
+	m.statusLock.RLock()
+	defer m.statusLock.RUnlock()
+	return m.seed
+}
+
+// applySeed runs on the router goroutine, so endpoints added later get the new seed too.
+func (m *Manager) applySeed(seed int64, routeMap map[int]chan<- interface{}) {
+	m.logger.Info("Reseeding endpoints", "seed", seed)
+	m.statusLock.Lock()
+	m.seed = seed
+	m.statusLock.Unlock()
+
+	m.journal.RecordSeed(seed)
+	for _, routeChan := range routeMap {
+		routeChan <- reseed{seed}
+	}
+}
+
+func (m *Manager) setProfiles(profiles []ImpairmentProfile) {
+	byName := make(map[string]*ImpairmentProfile, len(profiles))
+	for i := range profiles {
+		profile := profiles[i]
+		byName[profile.Name] = &profile
+	}
+
+	m.profileLock.Lock()
+	defer m.profileLock.Unlock()
+	m.profiles = byName
+}
+
+func (m *Manager) profile(name string) *ImpairmentProfile {
+	m.profileLock.RLock()
+	defer m.profileLock.RUnlock()
+	return m.profiles[name]
+}
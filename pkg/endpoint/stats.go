@@ -0,0 +1,170 @@
+package endpoint
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"endpoint-visualiser-server/pkg/logging"
+)
+
+const defaultStatsInterval = 5 * time.Second
+
+// latencyWindow is how far back the latency percentiles in EndpointStatsMessage look.
+const latencyWindow = time.Minute
+
+// maxLatencySamples bounds the window's memory at high request rates, dropping the oldest first.
+const maxLatencySamples = 10000
+
+// trafficTally counts an endpoint's traffic for the life of the endpoint, across connects.
+// Requests are answered on their own goroutines, so it has its own lock. Heartbeats aren't
+// traffic, so their initiator has a nil *trafficTally, which counts nothing.
+type trafficTally struct {
+	lock        sync.Mutex
+	requests    int64
+	responses   int64 // Including errors.
+	outstanding int
+	latencies   []latencySample // Oldest first.
+}
+
+type latencySample struct {
+	at time.Time
+	ms int
+}
+
+func (t *trafficTally) requestSent() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.requests++
+	t.outstanding++
+}
+
+func (t *trafficTally) responseSent(at time.Time, delayMS int) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.responses++
+	t.outstanding--
+	if len(t.latencies) == maxLatencySamples {
+		t.latencies = t.latencies[1:]
+	}
+	t.latencies = append(t.latencies, latencySample{at, delayMS})
+}
+
+// responseUnsent takes back a responseSent that never reached clients, leaving its request
+// abandoned.
+func (t *trafficTally) responseUnsent(at time.Time, delayMS int) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.responses--
+	for i := len(t.latencies) - 1; i >= 0; i-- {
+		if t.latencies[i] == (latencySample{at, delayMS}) {
+			t.latencies = append(t.latencies[:i], t.latencies[i+1:]...)
+			break
+		}
+	}
+}
+
+// abandoned is a request that was sent and will never be answered.
+func (t *trafficTally) abandoned() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.outstanding--
+}
+
+// LatencyPercentiles are nearest-rank percentiles of simulated response delays, not including
+// the client render latency. They're all zero when there are no samples.
+type LatencyPercentiles struct {
+	Samples int `json:"samples"`
+	P50     int `json:"p50"`
+	P95     int `json:"p95"`
+	P99     int `json:"p99"`
+}
+
+// snapshot prunes samples that have left the window as of now.
+func (t *trafficTally) snapshot(now time.Time) (requests, responses int64, outstanding int, latency LatencyPercentiles) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	cutoff := now.Add(-latencyWindow)
+	first := sort.Search(len(t.latencies), func(i int) bool { return t.latencies[i].at.After(cutoff) })
+	t.latencies = t.latencies[first:]
+
+	sorted := make([]int, len(t.latencies))
+	for i, sample := range t.latencies {
+		sorted[i] = sample.ms
+	}
+	sort.Ints(sorted)
+	latency = LatencyPercentiles{
+		Samples: len(sorted),
+		P50:     nearestRank(sorted, 50),
+		P95:     nearestRank(sorted, 95),
+		P99:     nearestRank(sorted, 99),
+	}
+	return t.requests, t.responses, t.outstanding, latency
+}
+
+func nearestRank(sorted []int, percentile int) int {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (percentile*len(sorted) + 99) / 100 // ceil(p/100 * n)
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// EndpointStatsMessage summarises an endpoint's traffic for clients, every stats interval.
+// Counts are since the server started, latencies are over the last minute and the achieved
+// rate is over the interval.
+type EndpointStatsMessage struct {
+	RequestID       messageID          `json:"id"`
+	Requests        int64              `json:"requests"`
+	Responses       int64              `json:"responses"`
+	Outstanding     int                `json:"outstanding"`
+	TargetTPS       float64            `json:"targetTPS"` // Zero when the generator sets the pace.
+	AchievedTPS     float64            `json:"achievedTPS"`
+	LatencyMS       LatencyPercentiles `json:"latencyMS"`
+	WindowMS        int64              `json:"windowMS"`
+	State           string             `json:"state"`
+	ResponseDelayMS int                `json:"responseDelayMS"`
+	Impairment      string             `json:"impairmentProfile,omitempty"`
+	Failures        FailureModes       `json:"failures"`
+}
+
+// statsTick is sent to every processor each stats interval, see WithStatsInterval.
+type statsTick struct{}
+
+func (m *Manager) sendStats(ep *managedEndpoint, state endpointProcessingState) {
+	now := m.clock.Now()
+	requests, responses, outstanding, latency := ep.tally.snapshot(now)
+	stats := EndpointStatsMessage{
+		RequestID:       endpointStats,
+		Requests:        requests,
+		Responses:       responses,
+		Outstanding:     outstanding,
+		TargetTPS:       state.targetTPS,
+		AchievedTPS:     ep.meter.rate(now, requests),
+		LatencyMS:       latency,
+		WindowMS:        latencyWindow.Milliseconds(),
+		State:           state.endpointState.String(),
+		ResponseDelayMS: state.currentDelayState.nominalMS(),
+		Impairment:      state.currentDelayState.profileName(),
+		Failures:        state.failures,
+	}
+	if err := ep.sender(stats); err != nil {
+		m.logger.Debug("Couldn't send stats to clients", logging.EndpointID, ep.config.ID, logging.Err, err)
+	}
+}
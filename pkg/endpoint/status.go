@@ -0,0 +1,140 @@
+package endpoint
+
+import (
+	"time"
+
+	"endpoint-visualiser-server/pkg/logging"
+	"endpoint-visualiser-server/pkg/metrics"
+)
+
+func (s epState) String() string {
+	switch s {
+	case epStateDown:
+		return "Down"
+	case epStateUpWaiting:
+		return "UpWaiting"
+	case epStateUpReceiving:
+		return "UpReceiving"
+	case epStateImpared:
+		return "Impaired"
+	}
+	return "Unknown"
+}
+
+// EndpointStatus is a snapshot of an endpoint processor's state machine, safe to hand to other goroutines.
+type EndpointStatus struct {
+	ID              int          `json:"id"`
+	State           string       `json:"state"`
+	ResponseDelayMS int          `json:"responseDelayMS"`
+	Impairment      string       `json:"impairmentProfile,omitempty"`
+	Failures        FailureModes `json:"failures"`
+	TargetTPS       float64      `json:"targetTPS,omitempty"`
+	InStateSince    time.Time    `json:"inStateSince"`
+	TimeInStateMS   int64        `json:"timeInStateMS"`
+	LastEvent       string       `json:"lastEvent,omitempty"`
+	LastEventAt     *time.Time   `json:"lastEventAt,omitempty"`
+	Viewers         int          `json:"viewers"`
+	Pool            *PoolStats   `json:"pool,omitempty"`
+}
+
+// EndpointStatus returns the live status of one endpoint, false if it isn't managed.
+func (m *Manager) EndpointStatus(id int) (EndpointStatus, bool) {
+	m.statusLock.RLock()
+	defer m.statusLock.RUnlock()
+	status, ok := m.statuses[id]
+	if !ok {
+		return EndpointStatus{}, false
+	}
+	return m.withLiveDetail(status), true
+}
+
+// EndpointStatuses returns the live status of every endpoint, in config order.
+func (m *Manager) EndpointStatuses() []EndpointStatus {
+	m.statusLock.RLock()
+	defer m.statusLock.RUnlock()
+	statuses := make([]EndpointStatus, 0, len(m.config))
+	for _, ep := range m.config {
+		if status, ok := m.statuses[ep.ID]; ok {
+			statuses = append(statuses, m.withLiveDetail(status))
+		}
+	}
+	return statuses
+}
+
+// withLiveDetail fills in what changes between events. Callers must hold statusLock.
+func (m *Manager) withLiveDetail(status EndpointStatus) EndpointStatus {
+	status.TimeInStateMS = int64(m.clock.Now().Sub(status.InStateSince) / time.Millisecond)
+	if pool := m.pools[status.ID]; pool != nil {
+		stats := pool.stats()
+		status.Pool = &stats
+	}
+	return status
+}
+
+// SubscribersChanged is the websocket manager's hook for telling us how many clients are
+// watching an endpoint.
+func (m *Manager) SubscribersChanged(id int, subscribers int) {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	status, ok := m.statuses[id]
+	if !ok {
+		return
+	}
+	status.Viewers = subscribers
+	m.statuses[id] = status
+	if subscribers == 0 {
+		m.logger.Info("Nobody is watching endpoint any more", logging.EndpointID, id)
+	}
+}
+
+// publishStatus is called by the endpoint processor after every event it receives.
+func (m *Manager) publishStatus(id int, state endpointProcessingState, pool *connectionPool, lastEvent string) {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+
+	m.pools[id] = pool
+	now := m.clock.Now()
+	status, ok := m.statuses[id]
+	if !ok || status.State != state.endpointState.String() {
+		status.InStateSince = now
+	}
+	status.ID = id
+	status.State = state.endpointState.String()
+	status.ResponseDelayMS = state.currentDelayState.nominalMS()
+	status.Impairment = state.currentDelayState.profileName()
+	status.Failures = state.failures
+	status.TargetTPS = state.targetTPS
+	m.recordState(id, state)
+	if lastEvent != "" {
+		status.LastEvent = lastEvent
+		status.LastEventAt = &now
+	}
+	m.statuses[id] = status
+}
+
+func (m *Manager) forgetStatus(id int) {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	delete(m.statuses, id)
+	delete(m.pools, id)
+	m.metrics.Forget(id)
+}
+
+var allStates = []epState{epStateDown, epStateUpWaiting, epStateUpReceiving, epStateImpared}
+
+func (m *Manager) recordState(id int, state endpointProcessingState) {
+	endpoint := metrics.Endpoint(id)
+	for _, s := range allStates {
+		current := 0.0
+		if s == state.endpointState {
+			current = 1
+		}
+		m.metrics.EndpointState.Set(current, endpoint, s.String())
+	}
+
+	delay := float64(state.currentDelayState.nominalMS()) / 1000
+	if state.currentDelayState.nominalMS() == stopRespondingMS {
+		delay = -1
+	}
+	m.metrics.ConfiguredDelay.Set(delay, endpoint)
+}
@@ -0,0 +1,118 @@
+package endpoint
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"endpoint-visualiser-server/pkg/event"
+)
+
+// tpsSteps are the rates RaiseTPSEvent and LowerTPSEvent step between. Zero is no target,
+// leaving the endpoint's generator to set the pace.
+var tpsSteps = []float64{0, 0.5, 1, 2, 5, 10, 20, 50, 100}
+
+// stepTPS moves to the next step above (or below) current, which needn't be a step itself.
+func stepTPS(current float64, up bool) float64 {
+	if up {
+		i := sort.Search(len(tpsSteps), func(i int) bool { return tpsSteps[i] > current })
+		if i == len(tpsSteps) {
+			return current
+		}
+		return tpsSteps[i]
+	}
+	i := sort.Search(len(tpsSteps), func(i int) bool { return tpsSteps[i] >= current })
+	if i == 0 {
+		return 0
+	}
+	return tpsSteps[i-1]
+}
+
+// pacer holds a traffic initiator to its target rate. Requests are scheduled against the clock
+// rather than after each other, so neither slow responses (requests are answered on their own
+// goroutines) nor timer latency make the rate drift.
+type pacer struct {
+	tps      float64
+	interval time.Duration // Zero when there's no target.
+	next     time.Time     // When the next request is due.
+}
+
+// maxCatchUp is how far behind schedule the pacer will try to make up, rather than start afresh.
+const maxCatchUp = time.Second
+
+func newPacer(tps float64, now time.Time) *pacer {
+	p := &pacer{}
+	p.setTarget(tps, now)
+	return p
+}
+
+func (p *pacer) paced() bool { return p.interval > 0 }
+
+func (p *pacer) setTarget(tps float64, now time.Time) {
+	p.tps, p.interval = tps, 0
+	if tps > 0 {
+		p.interval = seconds(1 / tps)
+	}
+	p.next = now
+}
+
+// wait schedules the next request after the one being sent now, returning how long until it's due.
+func (p *pacer) wait(now time.Time) time.Duration {
+	p.next = p.next.Add(p.interval)
+	if now.Sub(p.next) > maxCatchUp {
+		p.next = now
+	}
+	return p.next.Sub(now)
+}
+
+// rateMeter works out the request rate actually achieved, which a busy connection pool can
+// hold below the target.
+type rateMeter struct {
+	since time.Time
+	last  int64 // Requests sent to clients as of since.
+}
+
+// rate since the last call, given how many requests have been sent in all.
+func (r *rateMeter) rate(now time.Time, sent int64) float64 {
+	elapsed := now.Sub(r.since).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(sent-r.last) / elapsed
+	}
+	r.since, r.last = now, sent
+	return rate
+}
+
+// TPS Handlers
+type EndpointTargetTPSMessage struct {
+	RequestID messageID `json:"id"`
+	TargetTPS float64   `json:"targetTPS"`
+}
+
+func tpsEventPredicate(currentState endpointProcessingState) bool { return true }
+
+func (m *Manager) tpsHandler(previousState endpointProcessingState, ep *managedEndpoint, tps float64) (interface{}, endpointProcessingState) {
+	newState := previousState
+	newState.targetTPS = tps
+	m.changeBehaviour(ep, newState.behaviour())
+	return EndpointTargetTPSMessage{endpointTargetTPS, tps}, newState
+}
+
+func (m *Manager) raiseTPSEventAction(previousState endpointProcessingState, ep *managedEndpoint) (interface{}, endpointProcessingState) {
+	return m.tpsHandler(previousState, ep, stepTPS(previousState.targetTPS, true))
+}
+
+func (m *Manager) lowerTPSEventAction(previousState endpointProcessingState, ep *managedEndpoint) (interface{}, endpointProcessingState) {
+	return m.tpsHandler(previousState, ep, stepTPS(previousState.targetTPS, false))
+}
+
+// targetTPSEventHandler builds the handler for a TargetTPSEvent's rate.
+func (m *Manager) targetTPSEventHandler(e fmt.Stringer) (eventHandler, bool) {
+	target, ok := e.(event.TargetTPSEvent)
+	if !ok {
+		return eventHandler{}, false
+	}
+	return eventHandler{tpsEventPredicate, func(previousState endpointProcessingState, ep *managedEndpoint) (interface{}, endpointProcessingState) {
+		return m.tpsHandler(previousState, ep, target.TPS)
+	}}, true
+}
@@ -0,0 +1,391 @@
+package endpoint_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"endpoint-visualiser-server/pkg/clock"
+	"endpoint-visualiser-server/pkg/endpoint"
+	"endpoint-visualiser-server/pkg/event"
+)
+
+// scriptedSource returns its values, in order, as the value each rand.Intn(n) call sees, so
+// Intn(n) gives value % n. Past the end of the script it returns zeros.
+type scriptedSource struct {
+	values []int64
+}
+
+func (s *scriptedSource) Int63() int64 {
+	if len(s.values) == 0 {
+		return 0
+	}
+	v := s.values[0]
+	s.values = s.values[1:]
+	return v << 32 // Intn works from the top 31 bits.
+}
+
+func (s *scriptedSource) Seed(int64) {}
+
+func TestTrafficFollowsClockAndRandSource(t *testing.T) {
+	eventChan := make(chan event.Event)
+	clients := newRecordingClients(1)
+	start := time.Unix(0, 0)
+	fakeClock := clock.NewFake(start)
+	// Heartbeats and traffic each read the script from the start, from their own sources.
+	script := []int64{
+		1, 500, 0, // Traffic: 🐤, next message 500ms later, respond. Heartbeat: respond.
+		4, 1000, 0, // 🍋, next message 1s later, respond.
+	}
+
+	manager := endpoint.NewManager(eventChan,
+		endpoint.WithConfig([]endpoint.ManagableEndpoint{{ID: 0, Title: "HSM", MaxConns: 4}}),
+		endpoint.WithWebSocketTarget(clients),
+		endpoint.WithClock(fakeClock),
+		endpoint.WithRandSource(func(int64) rand.Source { return &scriptedSource{values: script} }),
+		endpoint.WithStatsInterval(0),
+	)
+	manager.Start(context.Background(), &sync.WaitGroup{})
+
+	eventChan <- event.Event{Destination: 0, Event: event.ConnectEvent{}}
+	// The first heartbeat can race the connected message to the clients.
+	first, second := <-clients.received[0], <-clients.received[0]
+	if _, connected := first.(endpoint.EndpointConnectedMessage); !connected {
+		first, second = second, first
+	}
+	if _, connected := first.(endpoint.EndpointConnectedMessage); !connected {
+		t.Fatalf("got %#v and %#v, want a connected message and a heartbeat", first, second)
+	}
+	if request, ok := second.(endpoint.TrafficMessage); !ok || request.ID != "TrafficRequest" || request.CorrelationID != "0-1" {
+		t.Fatalf("got %#v, want a heartbeat request", second)
+	}
+	fakeClock.BlockUntil(2) // The next heartbeat and the response.
+	fakeClock.Advance(400 * time.Millisecond)
+	clients.expectExactly(t, 0, traffic("TrafficResponse", "❤️", 1, start, start.Add(400*time.Millisecond)))
+
+	eventChan <- event.Event{Destination: 0, Event: event.StartTrafficEvent{}}
+	clients.expectExactly(t, 0, traffic("TrafficRequest", "🐤", 2, start.Add(400*time.Millisecond), time.Time{}))
+	fakeClock.BlockUntil(2) // The next message and the response.
+	fakeClock.Advance(400 * time.Millisecond)
+	clients.expectExactly(t, 0, traffic("TrafficResponse", "🐤", 2, start.Add(400*time.Millisecond), start.Add(800*time.Millisecond)))
+
+	fakeClock.BlockUntil(1)
+	fakeClock.Advance(99 * time.Millisecond)
+	clients.expectNone(t, 0, func(interface{}) bool { return true }, 50*time.Millisecond)
+	fakeClock.Advance(time.Millisecond)
+	clients.expectExactly(t, 0, traffic("TrafficRequest", "🍋", 3, start.Add(900*time.Millisecond), time.Time{}))
+}
+
+func TestTrafficRejectedWhilePoolExhausted(t *testing.T) {
+	eventChan := make(chan event.Event)
+	clients := newRecordingClients(1)
+	start := time.Unix(0, 0)
+	fakeClock := clock.NewFake(start)
+	script := []int64{1, 500, 0, 4, 1000, 0} // As in TestTrafficFollowsClockAndRandSource.
+
+	manager := endpoint.NewManager(eventChan,
+		endpoint.WithConfig([]endpoint.ManagableEndpoint{{ID: 0, Title: "HSM", MaxConns: 1}}),
+		endpoint.WithWebSocketTarget(clients),
+		endpoint.WithClock(fakeClock),
+		endpoint.WithRandSource(func(int64) rand.Source { return &scriptedSource{values: script} }),
+		endpoint.WithStatsInterval(0),
+	)
+	manager.Start(context.Background(), &sync.WaitGroup{})
+
+	// The heartbeat holds the only connection until its response, 400ms in.
+	eventChan <- event.Event{Destination: 0, Event: event.ConnectEvent{}}
+	clients.expect(t, 0, isTraffic("TrafficRequest"))
+	result := make(chan error, 1)
+	eventChan <- event.Event{Destination: 0, Event: event.StartTrafficEvent{}, Result: result}
+	if err := <-result; err != nil {
+		t.Fatalf("start traffic rejected: %s", err)
+	}
+	fakeClock.BlockUntil(2) // The heartbeat's response and the next message, the 🐤 was rejected.
+
+	expectPool := func(id string, want endpoint.PoolStats) {
+		t.Helper()
+		clients.expect(t, 0, func(msg interface{}) bool {
+			got, ok := msg.(endpoint.TrafficMessage)
+			if !ok || got.ID != id {
+				return false
+			}
+			if got.Pool == nil || *got.Pool != want {
+				t.Fatalf("%s %s: got pool %+v, want %+v", id, got.Character, got.Pool, want)
+			}
+			return true
+		})
+	}
+	fakeClock.Advance(400 * time.Millisecond)
+	expectPool("TrafficResponse", endpoint.PoolStats{Size: 1, Active: 0, Idle: 1, Rejected: 1})
+
+	fakeClock.BlockUntil(1)
+	fakeClock.Advance(100 * time.Millisecond)
+	clients.expectExactly(t, 0, traffic("TrafficRequest", "🍋", 2, start.Add(500*time.Millisecond), time.Time{}))
+	if status, _ := manager.EndpointStatus(0); status.Pool == nil || *status.Pool != (endpoint.PoolStats{Size: 1, Active: 1, Idle: 0, Rejected: 1}) {
+		t.Fatalf("unexpected pool in status %+v", status.Pool)
+	}
+}
+
+// traffic is a request, or its response if respondedAt is set.
+func traffic(id, character string, seq uint64, sentAt, respondedAt time.Time) endpoint.TrafficMessage {
+	msg := endpoint.TrafficMessage{ID: id, Character: character, CorrelationID: fmt.Sprintf("0-%d", seq), Seq: seq, RequestSentAt: sentAt}
+	if !respondedAt.IsZero() {
+		msg.ResponseSentAt = &respondedAt
+	}
+	return msg
+}
+
+// expectExactly fails unless the next message is want. Traffic is compared on everything but
+// the pool, other messages by type.
+func (c *recordingClients) expectExactly(t *testing.T, id int, want interface{}) {
+	t.Helper()
+	select {
+	case got := <-c.received[id]:
+		if wantTraffic, ok := want.(endpoint.TrafficMessage); ok {
+			gotTraffic, ok := got.(endpoint.TrafficMessage)
+			if ok {
+				gotTraffic.Pool = nil
+			}
+			if !ok || !reflect.DeepEqual(gotTraffic, wantTraffic) {
+				t.Fatalf("endpoint %d: got %#v, want %#v", id, got, wantTraffic)
+			}
+			return
+		}
+		if !isMessage(want)(got) {
+			t.Fatalf("endpoint %d: got %#v, want a %T", id, got, want)
+		}
+	case <-time.After(messageWait):
+		t.Fatalf("endpoint %d: expected %#v never arrived", id, want)
+	}
+}
+
+func TestTrafficHoldsTargetTPS(t *testing.T) {
+	eventChan := make(chan event.Event)
+	clients := newRecordingClients(1)
+	fakeClock := clock.NewFake(time.Unix(0, 0))
+
+	manager := endpoint.NewManager(eventChan,
+		endpoint.WithConfig([]endpoint.ManagableEndpoint{{ID: 0, Title: "HSM", MaxConns: 64}}),
+		endpoint.WithWebSocketTarget(clients),
+		endpoint.WithClock(fakeClock),
+		endpoint.WithSeed(1),
+		endpoint.WithStatsInterval(time.Second),
+	)
+	manager.Start(context.Background(), &sync.WaitGroup{})
+
+	send := func(e event.Event) {
+		result := make(chan error, 1)
+		e.Result = result
+		eventChan <- e
+		if err := <-result; err != nil {
+			t.Fatalf("%s: %s", e, err)
+		}
+	}
+	send(event.Event{Destination: 0, Event: event.ConnectEvent{}})
+	send(event.Event{Destination: 0, Event: event.RaiseTPSEvent{}})
+	send(event.Event{Destination: 0, Event: event.RaiseTPSEvent{}})
+	if status, _ := manager.EndpointStatus(0); status.TargetTPS != 1 {
+		t.Fatalf("two raises from nothing gave a target of %v, want 1", status.TargetTPS)
+	}
+	send(event.Event{Destination: 0, Event: event.TargetTPSEvent{TPS: 20}})
+	send(event.Event{Destination: 0, Event: event.StartTrafficEvent{}})
+
+	// The first request goes straight away, once the initiator's timers are all set.
+	isRequest := func(msg interface{}) bool {
+		request, ok := msg.(endpoint.TrafficMessage)
+		return ok && request.ID == "TrafficRequest" && request.Character != "❤️"
+	}
+	clients.expect(t, 0, isRequest)
+
+	// Responses take 400ms, far longer than the 50ms between requests, so up to 8 are waiting on
+	// theirs, as is the heartbeat sent on connect until then. Before each step, wait for those
+	// and the next request and stats timers to be set, so none is set after the clock moves on.
+	settle := func(requests int) {
+		inFlight := requests + 1
+		if requests > 8 {
+			inFlight = 8
+		}
+		fakeClock.BlockUntil(2 + inFlight)
+	}
+	requests := 1
+	for i := 0; i < 19; i++ {
+		settle(requests)
+		fakeClock.Advance(50 * time.Millisecond)
+		clients.expect(t, 0, isRequest)
+		requests++
+	}
+
+	// Stats come a second after the first request, along with the 21st.
+	settle(requests)
+	fakeClock.Advance(50 * time.Millisecond)
+	var stats endpoint.EndpointStatsMessage
+	clients.expect(t, 0, func(msg interface{}) bool {
+		var ok bool
+		stats, ok = msg.(endpoint.EndpointStatsMessage)
+		return ok
+	})
+	// A request or two due as the stats were sent may or may not have made it in.
+	if stats.TargetTPS != 20 || stats.AchievedTPS < 18 || stats.AchievedTPS > 22 {
+		t.Errorf("got %+v after %d requests, want about 20 TPS", stats, requests)
+	}
+}
+
+func TestStatsCountTrafficAndLatency(t *testing.T) {
+	eventChan := make(chan event.Event)
+	clients := newRecordingClients(1)
+	fakeClock := clock.NewFake(time.Unix(0, 0))
+
+	manager := endpoint.NewManager(eventChan,
+		endpoint.WithConfig([]endpoint.ManagableEndpoint{{ID: 0, Title: "HSM", MaxConns: 4,
+			Generator: endpoint.GeneratorConfig{Name: endpoint.ConstantGenerator, RatePerSecond: 1}}}),
+		endpoint.WithWebSocketTarget(clients),
+		endpoint.WithClock(fakeClock),
+		endpoint.WithRandSource(func(int64) rand.Source { return &scriptedSource{} }), // Always respond.
+		endpoint.WithStatsInterval(5*time.Second),
+	)
+	manager.Start(context.Background(), &sync.WaitGroup{})
+
+	send := func(e event.Event) {
+		result := make(chan error, 1)
+		e.Result = result
+		eventChan <- e
+		if err := <-result; err != nil {
+			t.Fatalf("%s: %s", e, err)
+		}
+	}
+	// The first request is answered straight away, the second after 500ms. Heartbeats, one
+	// either side of the traffic, aren't counted.
+	send(event.Event{Destination: 0, Event: event.ConnectEvent{}})
+	clients.expect(t, 0, isTraffic("TrafficRequest"))
+	send(event.Event{Destination: 0, Event: event.StartTrafficEvent{}})
+	clients.expect(t, 0, isGenerated("TrafficRequest")) // Its response is planned by now.
+	send(event.Event{Destination: 0, Event: event.DelayShortEvent{}})
+	fakeClock.BlockUntil(4) // Both responses, the next request and stats.
+	fakeClock.Advance(400 * time.Millisecond)
+	clients.expect(t, 0, isGenerated("TrafficResponse"))
+
+	fakeClock.BlockUntil(2)
+	fakeClock.Advance(600 * time.Millisecond)
+	clients.expect(t, 0, isGenerated("TrafficRequest"))
+	send(event.Event{Destination: 0, Event: event.StopTrafficEvent{}})
+	fakeClock.BlockUntil(4) // Both responses again, the next heartbeat and stats.
+	fakeClock.Advance(time.Second)
+	clients.expect(t, 0, isGenerated("TrafficResponse"))
+
+	send(event.Event{Destination: 0, Event: event.JitterEvent{MS: 50}}) // Too late to touch either response.
+	fakeClock.Advance(3 * time.Second)
+	var stats endpoint.EndpointStatsMessage
+	clients.expect(t, 0, func(msg interface{}) bool {
+		var ok bool
+		stats, ok = msg.(endpoint.EndpointStatsMessage)
+		return ok
+	})
+	want := endpoint.EndpointStatsMessage{
+		RequestID:       "EndpointStats",
+		Requests:        2,
+		Responses:       2,
+		AchievedTPS:     0.4,
+		LatencyMS:       endpoint.LatencyPercentiles{Samples: 2, P50: 0, P95: 500, P99: 500},
+		WindowMS:        60000,
+		State:           "UpWaiting",
+		ResponseDelayMS: 500,
+		Failures:        endpoint.FailureModes{JitterMS: 50},
+	}
+	if stats != want {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+}
+
+func TestTrafficCarriesOnFromRunToRun(t *testing.T) {
+	eventChan := make(chan event.Event)
+	clients := newRecordingClients(1)
+	fakeClock := clock.NewFake(time.Unix(0, 0)) // So each run sends just its first request.
+
+	manager := endpoint.NewManager(eventChan,
+		endpoint.WithConfig([]endpoint.ManagableEndpoint{{ID: 0, Title: "HSM", MaxConns: 64}}),
+		endpoint.WithWebSocketTarget(clients),
+		endpoint.WithClock(fakeClock),
+		endpoint.WithSeed(3),
+		endpoint.WithStatsInterval(0),
+	)
+	manager.Start(context.Background(), &sync.WaitGroup{})
+
+	send := func(e event.Event) {
+		result := make(chan error, 1)
+		e.Result = result
+		eventChan <- e
+		if err := <-result; err != nil {
+			t.Fatalf("%s: %s", e, err)
+		}
+	}
+	send(event.Event{Destination: 0, Event: event.ConnectEvent{}})
+
+	var runs []string
+	for i := 0; i < 4; i++ {
+		send(event.Event{Destination: 0, Event: event.StartTrafficEvent{}})
+		clients.expect(t, 0, func(msg interface{}) bool {
+			request, ok := msg.(endpoint.TrafficMessage)
+			if ok && request.ID == "TrafficRequest" && request.Character != "❤️" {
+				runs = append(runs, request.Character)
+				return true
+			}
+			return false
+		})
+		send(event.Event{Destination: 0, Event: event.StopTrafficEvent{}})
+	}
+
+	for _, character := range runs[1:] {
+		if character != runs[0] {
+			return
+		}
+	}
+	t.Errorf("every run started with %s, want each to carry on from the last", runs[0])
+}
+
+func TestHeartbeatsDontChangeTraffic(t *testing.T) {
+
+	// Reconnecting sends a heartbeat straight away, so the two endpoints see different numbers
+	// of heartbeats before their traffic starts.
+	characters := func(reconnects int) []string {
+		eventChan := make(chan event.Event)
+		clients := newRecordingClients(1)
+		manager := endpoint.NewManager(eventChan,
+			endpoint.WithConfig([]endpoint.ManagableEndpoint{{ID: 0, Title: "HSM", MaxConns: 64,
+				Generator: endpoint.GeneratorConfig{Name: endpoint.ConstantGenerator, RatePerSecond: 100}}}),
+			endpoint.WithWebSocketTarget(clients),
+			endpoint.WithSeed(7),
+		)
+		ctx, shutdown := context.WithCancel(context.Background())
+		defer shutdown()
+		manager.Start(ctx, &sync.WaitGroup{})
+
+		for i := 0; i < reconnects; i++ {
+			eventChan <- event.Event{Destination: 0, Event: event.ConnectEvent{}}
+			clients.expect(t, 0, isTraffic("TrafficRequest"))
+			eventChan <- event.Event{Destination: 0, Event: event.DisconnectEvent{}}
+		}
+		eventChan <- event.Event{Destination: 0, Event: event.ConnectEvent{}}
+		clients.expect(t, 0, isTraffic("TrafficRequest"))
+		eventChan <- event.Event{Destination: 0, Event: event.StartTrafficEvent{}}
+
+		var got []string
+		for len(got) < 10 {
+			clients.expect(t, 0, func(msg interface{}) bool {
+				request, ok := msg.(endpoint.TrafficMessage)
+				if ok && request.ID == "TrafficRequest" && request.Character != "❤️" {
+					got = append(got, request.Character)
+				}
+				return ok
+			})
+		}
+		return got
+	}
+
+	if once, thrice := characters(0), characters(3); !reflect.DeepEqual(once, thrice) {
+		t.Errorf("traffic changed with the number of heartbeats before it: %v then %v", once, thrice)
+	}
+}
@@ -1,16 +1,35 @@
 package event
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 type Event struct {
 	Destination int
 	Event       fmt.Stringer
+	Result      chan<- error // Optional. Receives the outcome once the event has been handled, so should be buffered.
 }
 
 func (e Event) String() string {
 	return e.Event.String()
 }
 
+// Reply reports the outcome of handling the event to whoever sent it, if they asked.
+func (e Event) Reply(err error) {
+	if e.Result != nil {
+		e.Result <- err
+	}
+}
+
+var (
+	ErrUnknownDestination = errors.New("no endpoint with that id exists")
+	ErrUnknownEvent       = errors.New("unknown event")
+	ErrRejected           = errors.New("event not valid in the endpoint's current state")
+)
+
 type ConnectEvent struct{}
 type StartTrafficEvent struct{}
 type StopTrafficEvent struct{}
@@ -20,6 +39,45 @@ type DelayLongEvent struct{}
 type StopRespondingEvent struct{}
 type StartRespondingEvent struct{}
 type DisconnectEvent struct{}
+type ClearFailuresEvent struct{}
+
+// RaiseTPSEvent and LowerTPSEvent step an endpoint's target request rate up or down.
+type RaiseTPSEvent struct{}
+type LowerTPSEvent struct{}
+
+// ImpairmentProfileEvent switches an endpoint to sampling its response delay from a named
+// profile in config, e.g. "ImpairmentProfileEvent:LongTail".
+type ImpairmentProfileEvent struct {
+	Profile string
+}
+
+// DropResponsesEvent makes an endpoint never answer Percent% of requests, e.g. "DropResponsesEvent:10".
+type DropResponsesEvent struct {
+	Percent int
+}
+
+// ErrorResponsesEvent makes an endpoint answer Percent% of requests with an error, e.g. "ErrorResponsesEvent:5".
+type ErrorResponsesEvent struct {
+	Percent int
+}
+
+// JitterEvent spreads responses +/- MS around the endpoint's delay, e.g. "JitterEvent:250".
+type JitterEvent struct {
+	MS int
+}
+
+// TargetTPSEvent sets the rate an endpoint sends requests at, e.g. "TargetTPSEvent:2.5".
+// "TargetTPSEvent:0" goes back to the endpoint's generator setting the pace.
+type TargetTPSEvent struct {
+	TPS float64
+}
+
+// BrownoutEvent slows an endpoint right down for DurationMS out of every PeriodMS,
+// e.g. "BrownoutEvent:10000,3000". "BrownoutEvent:0,0" turns brownouts off.
+type BrownoutEvent struct {
+	PeriodMS   int
+	DurationMS int
+}
 
 func (e ConnectEvent) String() string         { return "ConnectEvent" }
 func (e StartTrafficEvent) String() string    { return "StartTrafficEvent" }
@@ -29,4 +87,110 @@ func (e DelayMediumEvent) String() string     { return "DelayMediumEvent" }
 func (e DelayLongEvent) String() string       { return "DelayLongEvent" }
 func (e StopRespondingEvent) String() string  { return "StopRespondingEvent" }
 func (e StartRespondingEvent) String() string { return "StartRespondingEvent" }
-func (e DisconnectEvent) String() string      { return "String" }
+func (e DisconnectEvent) String() string      { return "DisconnectEvent" }
+func (e ClearFailuresEvent) String() string   { return "ClearFailuresEvent" }
+func (e RaiseTPSEvent) String() string        { return "RaiseTPSEvent" }
+func (e LowerTPSEvent) String() string        { return "LowerTPSEvent" }
+func (e ImpairmentProfileEvent) String() string {
+	return impairmentProfileEventName + argumentSeparator + e.Profile
+}
+func (e DropResponsesEvent) String() string {
+	return fmt.Sprintf("%s%s%d", dropResponsesEventName, argumentSeparator, e.Percent)
+}
+func (e ErrorResponsesEvent) String() string {
+	return fmt.Sprintf("%s%s%d", errorResponsesEventName, argumentSeparator, e.Percent)
+}
+func (e JitterEvent) String() string {
+	return fmt.Sprintf("%s%s%d", jitterEventName, argumentSeparator, e.MS)
+}
+func (e TargetTPSEvent) String() string {
+	return targetTPSEventName + argumentSeparator + strconv.FormatFloat(e.TPS, 'g', -1, 64)
+}
+func (e BrownoutEvent) String() string {
+	return fmt.Sprintf("%s%s%d,%d", brownoutEventName, argumentSeparator, e.PeriodMS, e.DurationMS)
+}
+
+const (
+	impairmentProfileEventName = "ImpairmentProfileEvent"
+	dropResponsesEventName     = "DropResponsesEvent"
+	errorResponsesEventName    = "ErrorResponsesEvent"
+	jitterEventName            = "JitterEvent"
+	brownoutEventName          = "BrownoutEvent"
+	targetTPSEventName         = "TargetTPSEvent"
+	argumentSeparator          = ":"
+)
+
+// MaxTargetTPS is the highest request rate a TargetTPSEvent can ask for.
+const MaxTargetTPS = 1000
+
+// Kind is an event's name without any argument, e.g. "JitterEvent" for "JitterEvent:250".
+func Kind(e fmt.Stringer) string {
+	return strings.SplitN(e.String(), argumentSeparator, 2)[0]
+}
+
+var knownEvents = map[string]fmt.Stringer{}
+
+func init() {
+	for _, e := range []fmt.Stringer{
+		ConnectEvent{},
+		StartTrafficEvent{},
+		StopTrafficEvent{},
+		DelayShortEvent{},
+		DelayMediumEvent{},
+		DelayLongEvent{},
+		StopRespondingEvent{},
+		StartRespondingEvent{},
+		DisconnectEvent{},
+		ClearFailuresEvent{},
+		RaiseTPSEvent{},
+		LowerTPSEvent{},
+	} {
+		knownEvents[e.String()] = e
+	}
+}
+
+// Lookup finds the event with the given name, e.g. "DelayLongEvent". Events that take an
+// argument are named "<event>:<argument>", e.g. "ImpairmentProfileEvent:LongTail".
+func Lookup(name string) (fmt.Stringer, error) {
+	if e, ok := knownEvents[name]; ok {
+		return e, nil
+	}
+	parts := strings.SplitN(name, argumentSeparator, 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownEvent, name)
+	}
+
+	kind, arg := parts[0], parts[1]
+	switch kind {
+	case impairmentProfileEventName:
+		return ImpairmentProfileEvent{Profile: arg}, nil
+	case dropResponsesEventName, errorResponsesEventName:
+		percent, err := strconv.Atoi(arg)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("%w: %s needs a percentage between 0 and 100", ErrUnknownEvent, name)
+		}
+		if kind == dropResponsesEventName {
+			return DropResponsesEvent{Percent: percent}, nil
+		}
+		return ErrorResponsesEvent{Percent: percent}, nil
+	case jitterEventName:
+		ms, err := strconv.Atoi(arg)
+		if err != nil || ms < 0 {
+			return nil, fmt.Errorf("%w: %s needs a non-negative number of milliseconds", ErrUnknownEvent, name)
+		}
+		return JitterEvent{MS: ms}, nil
+	case brownoutEventName:
+		var period, duration int
+		if _, err := fmt.Sscanf(arg, "%d,%d", &period, &duration); err != nil || duration < 0 || duration > period {
+			return nil, fmt.Errorf("%w: %s needs <periodMS>,<durationMS> with duration no longer than period", ErrUnknownEvent, name)
+		}
+		return BrownoutEvent{PeriodMS: period, DurationMS: duration}, nil
+	case targetTPSEventName:
+		tps, err := strconv.ParseFloat(arg, 64)
+		if err != nil || !(tps >= 0 && tps <= MaxTargetTPS) { // Also catches NaN.
+			return nil, fmt.Errorf("%w: %s needs a rate between 0 and %d requests per second", ErrUnknownEvent, name, MaxTargetTPS)
+		}
+		return TargetTPSEvent{TPS: tps}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownEvent, name)
+}
@@ -0,0 +1,56 @@
+// Package health is how the server's subsystems report whether they're alive, for /healthz,
+// and ready to serve, for /readyz.
+package health
+
+// Status is one subsystem's answer to either question.
+type Status struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func Up(detail string) Status {
+	return Status{OK: true, Detail: detail}
+}
+
+func Down(detail string) Status {
+	return Status{OK: false, Detail: detail}
+}
+
+// Checker is a subsystem that can report on itself. Live is false if it has stopped working
+// and won't recover, Ready is false if it isn't able to serve yet (or any more).
+type Checker interface {
+	Live() Status
+	Ready() Status
+}
+
+// Subsystem names a Checker in a Report.
+type Subsystem struct {
+	Name    string
+	Checker Checker
+}
+
+// Report is every subsystem's status, OK only if they all are.
+type Report struct {
+	OK         bool              `json:"ok"`
+	Subsystems map[string]Status `json:"subsystems"`
+}
+
+// Liveness asks every subsystem whether it's alive.
+func Liveness(subsystems []Subsystem) Report {
+	return report(subsystems, Checker.Live)
+}
+
+// Readiness asks every subsystem whether it's ready.
+func Readiness(subsystems []Subsystem) Report {
+	return report(subsystems, Checker.Ready)
+}
+
+func report(subsystems []Subsystem, check func(Checker) Status) Report {
+	r := Report{OK: true, Subsystems: make(map[string]Status, len(subsystems))}
+	for _, s := range subsystems {
+		status := check(s.Checker)
+		r.Subsystems[s.Name] = status
+		r.OK = r.OK && status.OK
+	}
+	return r
+}
@@ -0,0 +1,217 @@
+// Package journal records what the simulator did as JSON Lines, so a session can be examined
+// or replayed afterwards.
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"endpoint-visualiser-server/pkg/clock"
+	"endpoint-visualiser-server/pkg/event"
+	"endpoint-visualiser-server/pkg/logging"
+)
+
+// Kinds of entry.
+const (
+	KindSession    = "session"    // First entry in every file.
+	KindEvent      = "event"      // An event.Event consumed by the endpoint router.
+	KindTransition = "transition" // An endpoint processor handling an event.
+	KindMessage    = "message"    // A payload sent to an endpoint's clients.
+	KindSeed       = "seed"       // What the endpoints' random sequences were seeded with.
+)
+
+// Entry is one line of the journal. ElapsedNS is from the monotonic clock, since the journal
+// was opened, so it's safe to order and time entries by even if the wall clock jumps.
+type Entry struct {
+	Seq        uint64          `json:"seq"`
+	Time       time.Time       `json:"time"`
+	ElapsedNS  int64           `json:"elapsedNS"`
+	Kind       string          `json:"kind"`
+	EndpointID int             `json:"endpointId,omitempty"`
+	Event      string          `json:"event,omitempty"`
+	From       string          `json:"from,omitempty"`
+	To         string          `json:"to,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	Seed       int64           `json:"seed,omitempty"`
+}
+
+// Journal appends entries to a file, starting a new one when it grows past maxBytes or Rotate
+// is called. A nil *Journal records nothing, so callers needn't check whether journalling is on.
+type Journal struct {
+	path     string
+	maxBytes int64
+	started  time.Time
+	logger   logging.Logger
+	clock    clock.Clock
+
+	lock    sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+	written int64
+	seq     uint64
+	seed    *int64 // The last recorded, nil until there is one.
+}
+
+type Option func(*Journal)
+
+// WithMaxBytes rotates the journal once it's grown past n bytes. Zero, the default, never rotates.
+func WithMaxBytes(n int64) Option {
+	return func(j *Journal) {
+		j.maxBytes = n
+	}
+}
+
+func WithLogger(l logging.Logger) Option {
+	return func(j *Journal) {
+		j.logger = l
+	}
+}
+
+// WithClock times entries by c rather than the wall clock, e.g. the fake the endpoints run on.
+func WithClock(c clock.Clock) Option {
+	return func(j *Journal) {
+		j.clock = c
+	}
+}
+
+// Open appends to the journal at path, creating it if need be.
+func Open(path string, opts ...Option) (*Journal, error) {
+	j := &Journal{path: path, logger: logging.Discard(), clock: clock.Real()}
+	for _, opt := range opts {
+		opt(j)
+	}
+	j.started = j.clock.Now()
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// open must be called with lock held.
+func (j *Journal) open() error {
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	j.file, j.written = file, info.Size()
+	j.encoder = json.NewEncoder(countingWriter{j})
+	return j.write(Entry{Kind: KindSession})
+}
+
+// Rotate moves the current file aside, named after when it was rotated and its last entry,
+// and starts a new one.
+func (j *Journal) Rotate() error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.rotate()
+}
+
+// rotate must be called with lock held. The new file starts with the seed in force, so it can
+// be replayed on its own.
+func (j *Journal) rotate() error {
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s.%d", j.path, j.clock.Now().Format("20060102T150405"), j.seq)
+	if err := os.Rename(j.path, rotated); err != nil {
+		j.open() // Carry on with the old file rather than lose entries.
+		return err
+	}
+	j.logger.Info("Journal rotated", "path", rotated)
+	if err := j.open(); err != nil {
+		return err
+	}
+	if j.seed == nil {
+		return nil
+	}
+	return j.write(Entry{Kind: KindSeed, Seed: *j.seed})
+}
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.file.Close()
+}
+
+// RecordEvent notes an event as the endpoint router consumed it.
+func (j *Journal) RecordEvent(e event.Event) {
+	j.record(Entry{Kind: KindEvent, EndpointID: e.Destination, Event: e.String()})
+}
+
+// RecordTransition notes an endpoint handling an event, moving from one state to another
+// unless err says why it didn't.
+func (j *Journal) RecordTransition(id int, e string, from, to string, err error) {
+	entry := Entry{Kind: KindTransition, EndpointID: id, Event: e, From: from, To: to}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	j.record(entry)
+}
+
+// RecordSeed notes the seed traffic is generated from from now on, so it can be replayed.
+func (j *Journal) RecordSeed(seed int64) {
+	j.record(Entry{Kind: KindSeed, Seed: seed})
+}
+
+// RecordMessage notes a payload sent to an endpoint's clients.
+func (j *Journal) RecordMessage(id int, payload interface{}) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		raw, _ = json.Marshal(err.Error())
+	}
+	j.record(Entry{Kind: KindMessage, EndpointID: id, Payload: raw})
+}
+
+func (j *Journal) record(entry Entry) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.maxBytes > 0 && j.written >= j.maxBytes {
+		if err := j.rotate(); err != nil {
+			j.logger.Error("Couldn't rotate journal", "path", j.path, logging.Err, err)
+		}
+	}
+	if err := j.write(entry); err != nil {
+		j.logger.Error("Couldn't write to journal", "path", j.path, logging.Err, err)
+	}
+	if entry.Kind == KindSeed {
+		j.seed = &entry.Seed
+	}
+}
+
+// write must be called with lock held.
+func (j *Journal) write(entry Entry) error {
+	j.seq++
+	now := j.clock.Now()
+	entry.Seq, entry.Time, entry.ElapsedNS = j.seq, now, now.Sub(j.started).Nanoseconds()
+	return j.encoder.Encode(entry)
+}
+
+type countingWriter struct{ j *Journal }
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.j.file.Write(p)
+	w.j.written += int64(n)
+	return n, err
+}
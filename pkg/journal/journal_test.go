@@ -0,0 +1,103 @@
+package journal_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"endpoint-visualiser-server/pkg/event"
+	"endpoint-visualiser-server/pkg/journal"
+)
+
+func readEntries(t *testing.T, path string) []journal.Entry {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("couldn't open journal: %s", err)
+	}
+	defer file.Close()
+
+	var entries []journal.Entry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry journal.Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("bad journal line %q: %s", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestJournalRecordsInOrder(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, err := journal.Open(path)
+	if err != nil {
+		t.Fatalf("couldn't open journal: %s", err)
+	}
+
+	j.RecordEvent(event.Event{Destination: 1, Event: event.ConnectEvent{}})
+	j.RecordTransition(1, "ConnectEvent", "Down", "UpWaiting", nil)
+	j.RecordMessage(1, map[string]string{"id": "EndpointConnected"})
+	j.RecordTransition(1, "ConnectEvent", "UpWaiting", "UpWaiting", errors.New("rejected"))
+	j.Close()
+
+	entries := readEntries(t, path)
+	kinds := []string{journal.KindSession, journal.KindEvent, journal.KindTransition, journal.KindMessage, journal.KindTransition}
+	if len(entries) != len(kinds) {
+		t.Fatalf("expected %d entries, got %d", len(kinds), len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Kind != kinds[i] || entry.Seq != uint64(i+1) {
+			t.Errorf("entry %d: expected %s with seq %d, got %+v", i, kinds[i], i+1, entry)
+		}
+		if i > 0 && entry.ElapsedNS < entries[i-1].ElapsedNS {
+			t.Errorf("entry %d went back in time", i)
+		}
+	}
+	if entries[1].Event != "ConnectEvent" || entries[1].EndpointID != 1 {
+		t.Errorf("unexpected event entry %+v", entries[1])
+	}
+	if string(entries[3].Payload) != `{"id":"EndpointConnected"}` {
+		t.Errorf("unexpected payload %s", entries[3].Payload)
+	}
+	if entries[4].Error != "rejected" {
+		t.Errorf("expected the rejection to be recorded, got %+v", entries[4])
+	}
+}
+
+func TestJournalRotates(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "journal.jsonl")
+	j, err := journal.Open(path, journal.WithMaxBytes(512))
+	if err != nil {
+		t.Fatalf("couldn't open journal: %s", err)
+	}
+	j.RecordSeed(42)
+	for i := 0; i < 20; i++ {
+		j.RecordEvent(event.Event{Destination: i, Event: event.StartTrafficEvent{}})
+	}
+	if err := j.Rotate(); err != nil {
+		t.Fatalf("couldn't rotate: %s", err)
+	}
+	j.Close()
+
+	files, _ := filepath.Glob(path + ".*")
+	if len(files) < 2 {
+		t.Fatalf("expected the journal to have rotated more than once, got %v", files)
+	}
+	// Every file carries the seed, so each can be replayed on its own.
+	for _, file := range append(files, path) {
+		entries := readEntries(t, file)
+		if len(entries) < 2 || entries[0].Kind != journal.KindSession || entries[1].Kind != journal.KindSeed || entries[1].Seed != 42 {
+			t.Fatalf("%s: expected to start with the session and seed, got %+v", file, entries)
+		}
+	}
+	if entries := readEntries(t, path); len(entries) != 2 {
+		t.Fatalf("expected a fresh journal after rotating, got %+v", entries)
+	}
+}
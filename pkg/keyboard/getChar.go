@@ -4,7 +4,10 @@ import "github.com/pkg/term"
 
 // Returns either an ascii code, or (if input is an arrow) a Javascript key code.
 func GetChar() (ascii int, keyCode int, err error) {
-	t, _ := term.Open("/dev/tty")
+	t, err := term.Open("/dev/tty")
+	if err != nil {
+		return
+	}
 	term.RawMode(t)
 	bytes := make([]byte, 3)
 
@@ -0,0 +1,23 @@
+package keyboard
+
+import (
+	"endpoint-visualiser-server/pkg/health"
+)
+
+// Live is always true. Without a terminal to read, e.g. when running headless, the listener
+// stops and events can still arrive over REST, so that's reported but isn't a failure.
+func (l *Listener) Live() health.Status {
+	if status := l.status.Load(); status != nil {
+		return *status
+	}
+	return health.Up("not listening for keypresses")
+}
+
+func (l *Listener) Ready() health.Status {
+	return l.Live()
+}
+
+func (l *Listener) setStatus(detail string) {
+	status := health.Up(detail)
+	l.status.Store(&status)
+}
@@ -1,15 +1,26 @@
 package keyboard
 
 import (
+	"context"
 	"endpoint-visualiser-server/pkg/event"
-	"io/ioutil"
-	"log"
-	"os"
+	"endpoint-visualiser-server/pkg/logging"
+	"errors"
+	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
+
+	"endpoint-visualiser-server/pkg/health"
 )
 
+var ErrUnknownProfile = errors.New("no such keypress profile")
+
+// KeyPressProfile is a row of key bindings. It controls whichever endpoints are attached to it,
+// see WithAttachments, so one profile can drive several endpoints at once. IDs are positive, as
+// an endpoint's keyPressProfile of 0 means it has none.
 type KeyPressProfile struct {
 	ID                 int    `json:"ID"`
+	Endpoints          []int  `json:"Endpoints,omitempty"` // Attached when config loads, along with endpoints naming this profile.
 	ConnectKey         string `json:"Connect"`
 	StartTrafficKey    string `json:"StartTraffic"`
 	StopTrafficKey     string `json:"StopTraffic"`
@@ -19,13 +30,28 @@ type KeyPressProfile struct {
 	StopRespondingKey  string `json:"StopResponding"`
 	StartRespondingKey string `json:"StartResponding"`
 	DisconnectKey      string `json:"Disconnect"`
+
+	// ImpairmentKeys binds impairment profile names (from config) to keys.
+	ImpairmentKeys map[string]string `json:"Impairments,omitempty"`
+	// EventKeys binds any other event, by name, to a key, e.g. "JitterEvent:250": "-".
+	EventKeys map[string]string `json:"Events,omitempty"`
 }
 
 type Listener struct {
-	config    []KeyPressProfile
-	eventChan chan<- event.Event
-	keyMap    map[string]event.Event
-	logger    *log.Logger
+	config      []KeyPressProfile
+	eventChan   chan<- event.Event
+	keyLock     sync.RWMutex
+	keyMap      map[string]keyBinding
+	attachments map[int][]int // Endpoint IDs, by the profile ID controlling them.
+	quit        func()
+	logger      logging.Logger
+	status      atomic.Pointer[health.Status] // nil until started.
+}
+
+// keyBinding is what a key does, for every endpoint attached to profile.
+type keyBinding struct {
+	profile int
+	event   fmt.Stringer
 }
 
 type ListenerOption func(*Listener)
@@ -36,64 +62,199 @@ func WithConfig(config []KeyPressProfile) ListenerOption {
 	}
 }
 
-func WithLogger(lg *log.Logger) ListenerOption {
+// WithAttachments says which endpoints each profile controls, by profile ID.
+func WithAttachments(attachments map[int][]int) ListenerOption {
+	return func(l *Listener) {
+		l.attachments = attachments
+	}
+}
+
+// WithQuit is called when the quit key (backtick, or Ctrl-C as the terminal is in raw mode) is pressed.
+func WithQuit(quit func()) ListenerOption {
+	return func(l *Listener) {
+		l.quit = quit
+	}
+}
+
+func WithLogger(lg logging.Logger) ListenerOption {
 	return func(l *Listener) {
 		l.logger = lg
 	}
 }
 
 func NewListener(eventChan chan<- event.Event, opts ...ListenerOption) (*Listener, error) {
-	defaultDiscardLogger := log.New(ioutil.Discard, "", 0)
-	l := &Listener{logger: defaultDiscardLogger}
+	l := &Listener{logger: logging.Discard(), quit: func() {}}
 	for _, opt := range opts {
 		opt(l)
 	}
 
-	l.keyMap = make(map[string]event.Event, len(l.config))
-	l.populateKeyMap(l.config)
+	if err := l.Reconfigure(l.config, l.attachments); err != nil {
+		return nil, err
+	}
 	l.eventChan = eventChan
 
 	return l, nil
 }
 
-func (l *Listener) Start(synchStart *sync.WaitGroup) {
+// Start listens for keypresses until ctx is cancelled. A read that's already blocked waiting on
+// the terminal can't be interrupted, but nothing more is sent once ctx is done.
+func (l *Listener) Start(ctx context.Context, synchStart *sync.WaitGroup) {
 	synchStart.Add(1)
-	l.logger.Printf("Starting Key Listener...")
-	go l.keyLogger(l.keyMap, l.eventChan)
+	l.logger.Info("Starting key listener")
+	l.setStatus("listening for keypresses")
+	go l.keyLogger(ctx, l.eventChan)
 	synchStart.Done()
 }
 
-func (l *Listener) populateKeyMap(config []KeyPressProfile) {
+// Reconfigure swaps in a new set of key bindings and attachments, replacing any made with Attach.
+// The old ones stay in place if any binding is invalid.
+func (l *Listener) Reconfigure(config []KeyPressProfile, attachments map[int][]int) error {
+	keyMap, err := buildKeyMap(config)
+	if err != nil {
+		return err
+	}
+
+	copied := make(map[int][]int, len(attachments))
+	for profile, endpoints := range attachments {
+		copied[profile] = append([]int(nil), endpoints...)
+	}
+
+	l.keyLock.Lock()
+	defer l.keyLock.Unlock()
+	l.config = config
+	l.keyMap = keyMap
+	l.attachments = copied
+	return nil
+}
+
+// Attach makes a profile's keys control exactly the given endpoints, none if empty.
+func (l *Listener) Attach(profile int, endpoints []int) error {
+	l.keyLock.Lock()
+	defer l.keyLock.Unlock()
+	if !l.hasProfile(profile) {
+		return fmt.Errorf("%w: %d", ErrUnknownProfile, profile)
+	}
+	l.attachments[profile] = append([]int(nil), endpoints...)
+	l.logger.Info("Keypress profile attached", logging.Profile, profile, "endpoints", endpoints)
+	return nil
+}
+
+// Attachments lists the endpoints each profile controls, by profile ID. Every profile is present.
+func (l *Listener) Attachments() map[int][]int {
+	l.keyLock.RLock()
+	defer l.keyLock.RUnlock()
+	attachments := make(map[int][]int, len(l.config))
+	for _, profile := range l.config {
+		endpoints := append([]int{}, l.attachments[profile.ID]...)
+		sort.Ints(endpoints)
+		attachments[profile.ID] = endpoints
+	}
+	return attachments
+}
+
+// hasProfile must be called with keyLock held.
+func (l *Listener) hasProfile(id int) bool {
+	for _, profile := range l.config {
+		if profile.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// eventsFor returns an event for every endpoint attached to the profile the key belongs to.
+func (l *Listener) eventsFor(key string) []event.Event {
+	l.keyLock.RLock()
+	defer l.keyLock.RUnlock()
+	binding, ok := l.keyMap[key]
+	if !ok {
+		return nil
+	}
+	endpoints := l.attachments[binding.profile]
+	events := make([]event.Event, len(endpoints))
+	for i, id := range endpoints {
+		events[i] = event.Event{Destination: id, Event: binding.event}
+	}
+	return events
+}
+
+// KeyBinding is one of a profile's fixed bindings, by the name it has in config.
+type KeyBinding struct {
+	Name  string
+	Key   string
+	Event fmt.Stringer
+}
+
+func (p KeyPressProfile) KeyBindings() []KeyBinding {
+	return []KeyBinding{
+		{"Connect", p.ConnectKey, event.ConnectEvent{}},
+		{"StartTraffic", p.StartTrafficKey, event.StartTrafficEvent{}},
+		{"StopTraffic", p.StopTrafficKey, event.StopTrafficEvent{}},
+		{"Delay500ms", p.DelayShortKey, event.DelayShortEvent{}},
+		{"Delay1000ms", p.DelayMediumKey, event.DelayMediumEvent{}},
+		{"Delay5000ms", p.DelayLongKey, event.DelayLongEvent{}},
+		{"StopResponding", p.StopRespondingKey, event.StopRespondingEvent{}},
+		{"StartResponding", p.StartRespondingKey, event.StartRespondingEvent{}},
+		{"Disconnect", p.DisconnectKey, event.DisconnectEvent{}},
+	}
+}
+
+// buildKeyMap skips unset keys, so a profile needn't bind everything.
+func buildKeyMap(config []KeyPressProfile) (map[string]keyBinding, error) {
+	keyMap := make(map[string]keyBinding, len(config))
 	for _, profile := range config {
-		l.keyMap[profile.ConnectKey] = event.Event{Destination: profile.ID, Event: event.ConnectEvent{}}
-		l.keyMap[profile.StartTrafficKey] = event.Event{Destination: profile.ID, Event: event.StartTrafficEvent{}}
-		l.keyMap[profile.StopTrafficKey] = event.Event{Destination: profile.ID, Event: event.StopTrafficEvent{}}
-		l.keyMap[profile.DelayShortKey] = event.Event{Destination: profile.ID, Event: event.DelayShortEvent{}}
-		l.keyMap[profile.DelayMediumKey] = event.Event{Destination: profile.ID, Event: event.DelayMediumEvent{}}
-		l.keyMap[profile.DelayLongKey] = event.Event{Destination: profile.ID, Event: event.DelayLongEvent{}}
-		l.keyMap[profile.StopRespondingKey] = event.Event{Destination: profile.ID, Event: event.StopRespondingEvent{}}
-		l.keyMap[profile.StartRespondingKey] = event.Event{Destination: profile.ID, Event: event.StartRespondingEvent{}}
-		l.keyMap[profile.DisconnectKey] = event.Event{Destination: profile.ID, Event: event.DisconnectEvent{}}
+		bind := func(key string, e fmt.Stringer) {
+			if key != "" {
+				keyMap[key] = keyBinding{profile.ID, e}
+			}
+		}
+
+		for _, binding := range profile.KeyBindings() {
+			bind(binding.Key, binding.Event)
+		}
+		for impairment, key := range profile.ImpairmentKeys {
+			bind(key, event.ImpairmentProfileEvent{Profile: impairment})
+		}
+		for name, key := range profile.EventKeys {
+			e, err := event.Lookup(name)
+			if err != nil {
+				return nil, fmt.Errorf("key profile %d, key %q: %w", profile.ID, key, err)
+			}
+			bind(key, e)
+		}
 	}
+	return keyMap, nil
 }
 
-func (l *Listener) keyLogger(keyMap map[string]event.Event, sendChan chan<- event.Event) {
+const ctrlC = 3
+
+func (l *Listener) keyLogger(ctx context.Context, sendChan chan<- event.Event) {
 	for {
-		key, _, err := GetChar()
+		ascii, _, err := GetChar()
 		if err != nil {
-			l.logger.Printf("keypress error")
+			// No terminal (e.g. running headless), events can still arrive over REST.
+			l.logger.Warn("Key listener stopping, can't read keypresses", logging.Err, err)
+			l.setStatus("stopped, can't read keypresses: " + err.Error())
+			return
+		}
+		if ctx.Err() != nil {
+			return
 		}
+		key := string(rune(ascii))
 
-		// Hacky - need a way to quit the damn thing!
-		if string(key) == "`" {
-			l.logger.Printf("\nReceived Termination Signal - see ya!")
-			os.Exit(0)
+		if key == "`" || ascii == ctrlC {
+			l.logger.Info("Quit key pressed")
+			l.quit()
+			return
 		}
 
-		event := keyMap[string(key)]
-		if event.Event != nil {
-			l.logger.Printf("\nReceive KeyPress %s, sending %T event on sendchan", string(key), event.Event)
-			sendChan <- event
+		for _, event := range l.eventsFor(key) {
+			l.logger.Info("Keypress", logging.Key, key, logging.EndpointID, event.Destination, logging.Event, event.String())
+			select {
+			case sendChan <- event:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}
 }
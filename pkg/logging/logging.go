@@ -0,0 +1,62 @@
+// Package logging is the structured, leveled logging every other package writes through.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Logger is what each package's WithLogger option takes. *slog.Logger is the real one.
+// Arguments after msg are alternating keys and values, see the field names below.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// Field names shared across packages, so entries about the same thing can be filtered together.
+const (
+	EndpointID  = "endpoint_id"
+	Event       = "event"
+	StateFrom   = "state_from"
+	StateTo     = "state_to"
+	ClientAddr  = "client_addr"
+	Err         = "error"
+	Key         = "key"
+	Profile     = "profile"
+	Scenario    = "scenario"
+	Step        = "step"
+	Subscribers = "subscribers"
+	Message     = "message"
+)
+
+const (
+	TextFormat = "text"
+	JSONFormat = "json"
+)
+
+// Discard is the default for every package, so nothing is logged unless a logger is given.
+func Discard() Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// New logs to w in the given format, "text" or "json", at level and above.
+func New(w io.Writer, format string, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %q, use debug, info, warn or error", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case TextFormat:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case JSONFormat:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, use %s or %s", format, TextFormat, JSONFormat)
+	}
+}
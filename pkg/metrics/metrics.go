@@ -0,0 +1,95 @@
+// Package metrics exports the simulator's traffic and endpoint numbers in Prometheus text format.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Label names.
+const (
+	endpointLabel = "endpoint"
+	outcomeLabel  = "outcome"
+	reasonLabel   = "reason"
+	stateLabel    = "state"
+	eventLabel    = "event"
+)
+
+// Outcomes of a request, and reasons one was never answered.
+const (
+	OutcomeResponse = "response"
+	OutcomeError    = "error"
+
+	ReasonStopResponding = "stopResponding"
+	ReasonDropped        = "dropped"
+	ReasonDisconnected   = "disconnected" // The endpoint disconnected or shut down before responding.
+)
+
+// LatencyBuckets cover the fixed delays and then some, in seconds.
+var LatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 3, 5, 10}
+
+// Metrics is every metric the simulator exports, each labelled by endpoint ID.
+type Metrics struct {
+	registry *Registry
+
+	RequestsSent       *CounterVec
+	ResponsesSent      *CounterVec
+	RequestsUnanswered *CounterVec
+	RequestsRejected   *CounterVec
+	ResponseLatency    *HistogramVec
+	EndpointState      *GaugeVec
+	ConfiguredDelay    *GaugeVec
+	Subscribers        *GaugeVec
+	WriteErrors        *CounterVec
+	EventsReceived     *CounterVec
+}
+
+func New() *Metrics {
+	r := NewRegistry()
+	return &Metrics{
+		registry: r,
+
+		RequestsSent: r.NewCounterVec("epviz_requests_sent_total",
+			"Simulated requests sent to an endpoint.", endpointLabel),
+		ResponsesSent: r.NewCounterVec("epviz_responses_sent_total",
+			"Simulated responses from an endpoint, by outcome.", endpointLabel, outcomeLabel),
+		RequestsUnanswered: r.NewCounterVec("epviz_requests_unanswered_total",
+			"Simulated requests never answered, because the endpoint stopped responding or the request was dropped.", endpointLabel, reasonLabel),
+		RequestsRejected: r.NewCounterVec("epviz_requests_rejected_total",
+			"Simulated requests never sent, because every connection to the endpoint was busy.", endpointLabel),
+		ResponseLatency: r.NewHistogramVec("epviz_response_latency_seconds",
+			"Simulated response latency, before client render time.", LatencyBuckets, endpointLabel),
+		EndpointState: r.NewGaugeVec("epviz_endpoint_state",
+			"1 for the state an endpoint is in, 0 for the others.", endpointLabel, stateLabel),
+		ConfiguredDelay: r.NewGaugeVec("epviz_endpoint_configured_delay_seconds",
+			"Nominal response delay an endpoint is set to, -1 when it has stopped responding.", endpointLabel),
+		Subscribers: r.NewGaugeVec("epviz_websocket_subscribers",
+			"Websocket clients watching an endpoint.", endpointLabel),
+		WriteErrors: r.NewCounterVec("epviz_websocket_write_errors_total",
+			"Failed writes to an endpoint's websocket clients.", endpointLabel),
+		EventsReceived: r.NewCounterVec("epviz_events_received_total",
+			"Events received by an endpoint, by event kind.", endpointLabel, eventLabel),
+	}
+}
+
+// Endpoint formats an endpoint ID as a label value.
+func Endpoint(id int) string {
+	return strconv.Itoa(id)
+}
+
+// Forget drops every series about an endpoint that's been removed.
+func (m *Metrics) Forget(id int) {
+	endpoint := Endpoint(id)
+	m.registry.lock.Lock()
+	defer m.registry.lock.Unlock()
+	for _, f := range m.registry.families {
+		if len(f.labels) > 0 && f.labels[0] == endpointLabel {
+			f.DeleteMatching(endpoint)
+		}
+	}
+}
+
+func (m *Metrics) Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.registry.WriteTo(w)
+}
@@ -0,0 +1,230 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds metric families and writes them in the Prometheus text exposition format.
+type Registry struct {
+	lock     sync.Mutex
+	families []*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64 // Upper bounds, histograms only.
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64  // Counters and gauges.
+	counts      []uint64 // Per bucket, not cumulative. Histograms only.
+	sum         float64
+	count       uint64
+}
+
+func (r *Registry) register(name, help, kind string, buckets []float64, labels []string) *family {
+	f := &family{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*series)}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.families = append(r.families, f)
+	return f
+}
+
+// get must be called with f.lock held.
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s wants %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == histogramType {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) update(labelValues []string, apply func(s *series)) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	apply(f.get(labelValues))
+}
+
+// DeleteMatching drops every series whose first label values are these, e.g. everything
+// about an endpoint that's been removed.
+func (f *family) DeleteMatching(leadingValues ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for key, s := range f.series {
+		if len(s.labelValues) >= len(leadingValues) && equal(s.labelValues[:len(leadingValues)], leadingValues) {
+			delete(f.series, key)
+		}
+	}
+}
+
+func equal(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type CounterVec struct{ *family }
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(name, help, counterType, nil, labels)}
+}
+
+func (c *CounterVec) Inc(labelValues ...string) { c.Add(1, labelValues...) }
+
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	c.update(labelValues, func(s *series) { s.value += v })
+}
+
+type GaugeVec struct{ *family }
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(name, help, gaugeType, nil, labels)}
+}
+
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	g.update(labelValues, func(s *series) { s.value = v })
+}
+
+type HistogramVec struct{ *family }
+
+// NewHistogramVec takes bucket upper bounds in increasing order; +Inf is implied.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{r.register(name, help, histogramType, buckets, labels)}
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.update(labelValues, func(s *series) {
+		if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+			s.counts[i]++
+		}
+		s.sum += v
+		s.count++
+	})
+}
+
+// WriteTo writes every family in the Prometheus text format, series sorted by label values.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	families := append([]*family(nil), r.families...)
+	r.lock.Unlock()
+
+	out := &countingWriter{w: bufio.NewWriter(w)}
+	for _, f := range families {
+		f.writeTo(out)
+	}
+	if out.err == nil {
+		out.err = out.w.Flush()
+	}
+	return out.n, out.err
+}
+
+func (f *family) writeTo(out *countingWriter) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	out.printf("# HELP %s %s\n", f.name, escapeHelp(f.help))
+	out.printf("# TYPE %s %s\n", f.name, f.kind)
+
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].labelValues, "\xff") < strings.Join(all[j].labelValues, "\xff")
+	})
+
+	for _, s := range all {
+		if f.kind != histogramType {
+			out.printf("%s%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), formatValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			out.printf("%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "le", formatValue(bound)), cumulative)
+		}
+		out.printf("%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "le", "+Inf"), s.count)
+		out.printf("%s_sum%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), formatValue(s.sum))
+		out.printf("%s_count%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+labelEscaper.Replace(extraValue)+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) printf(format string, args ...interface{}) {
+	if c.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(c.w, format, args...)
+	c.n += int64(n)
+	c.err = err
+}
@@ -0,0 +1,55 @@
+package metrics_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"endpoint-visualiser-server/pkg/metrics"
+)
+
+func TestTextExposition(t *testing.T) {
+
+	r := metrics.NewRegistry()
+	requests := r.NewCounterVec("requests_total", "Requests.", "endpoint")
+	state := r.NewGaugeVec("state", "State.", "endpoint", "state")
+	latency := r.NewHistogramVec("latency_seconds", "Latency.", []float64{0.5, 1}, "endpoint")
+
+	requests.Inc("2")
+	requests.Add(2, "1")
+	state.Set(1, "1", `Up"Waiting`)
+	latency.Observe(0.25, "1")
+	latency.Observe(0.75, "1")
+	latency.Observe(3, "1")
+
+	var out bytes.Buffer
+	if _, err := r.WriteTo(&out); err != nil {
+		t.Fatalf("couldn't write metrics: %s", err)
+	}
+
+	want := `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{endpoint="1"} 2
+requests_total{endpoint="2"} 1
+# HELP state State.
+# TYPE state gauge
+state{endpoint="1",state="Up\"Waiting"} 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{endpoint="1",le="0.5"} 1
+latency_seconds_bucket{endpoint="1",le="1"} 2
+latency_seconds_bucket{endpoint="1",le="+Inf"} 3
+latency_seconds_sum{endpoint="1"} 4
+latency_seconds_count{endpoint="1"} 3
+`
+	if out.String() != want {
+		t.Fatalf("unexpected exposition, got:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	requests.DeleteMatching("1")
+	out.Reset()
+	r.WriteTo(&out)
+	if strings.Contains(out.String(), `requests_total{endpoint="1"}`) {
+		t.Fatalf("deleted series still exported:\n%s", out.String())
+	}
+}
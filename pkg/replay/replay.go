@@ -0,0 +1,147 @@
+// Package replay plays a journal's recorded events back through the endpoints as a scenario,
+// seeded as the original session was, so clients see the same traffic again.
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"endpoint-visualiser-server/pkg/journal"
+	"endpoint-visualiser-server/pkg/logging"
+	"endpoint-visualiser-server/pkg/scenario"
+)
+
+var (
+	ErrNoSeed       = errors.New("recording has no seed entry")
+	ErrNoEvents     = errors.New("recording has no events after its seed")
+	ErrBadSpeed     = errors.New("replay only runs at the recorded speed, 1, as traffic, response delays and heartbeats keep their own pace")
+	ErrBadRecording = errors.New("recording must be a file name in the journal directory")
+	ErrNoDirectory  = errors.New("no recording directory, replay needs one given by WithDirectory")
+)
+
+// Load reads the most recent take in a journal: everything from its last seed entry, which is
+// written when the endpoints start and whenever they're reseeded. Step offsets are the events'
+// time since that seed. speed must be 1: only the events' timing could be scaled, not the
+// endpoints', and traffic would no longer match.
+func Load(path string, speed float64) (scenario.Scenario, int64, error) {
+	if speed != 1 {
+		return scenario.Scenario{}, 0, ErrBadSpeed
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return scenario.Scenario{}, 0, err
+	}
+	defer file.Close()
+
+	var (
+		seed   int64
+		seeded bool
+		origin int64
+		steps  []scenario.Step
+	)
+	lines := bufio.NewScanner(file)
+	lines.Buffer(nil, 1<<20) // Message payloads can make for long lines.
+	for line := 1; lines.Scan(); line++ {
+		var entry journal.Entry
+		if err := json.Unmarshal(lines.Bytes(), &entry); err != nil {
+			return scenario.Scenario{}, 0, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		switch entry.Kind {
+		case journal.KindSeed:
+			seed, seeded, origin, steps = entry.Seed, true, entry.ElapsedNS, nil
+		case journal.KindEvent:
+			if !seeded {
+				continue
+			}
+			at := time.Duration(entry.ElapsedNS - origin)
+			steps = append(steps, scenario.Step{At: scenario.Offset(at), Endpoints: []int{entry.EndpointID}, Event: entry.Event})
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return scenario.Scenario{}, 0, fmt.Errorf("%s: %w", path, err)
+	}
+
+	switch {
+	case !seeded:
+		return scenario.Scenario{}, 0, ErrNoSeed
+	case len(steps) == 0:
+		return scenario.Scenario{}, 0, ErrNoEvents
+	}
+	s, err := scenario.New("Replay of "+filepath.Base(path), steps)
+	if err != nil {
+		return scenario.Scenario{}, 0, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, seed, nil
+}
+
+// Reseeder restarts the endpoints' random sequences. *endpoint.Manager is the real one.
+type Reseeder interface {
+	Reseed(seed int64)
+}
+
+// Player replays recordings on demand, replacing whatever scenario the runner had. Endpoints
+// keep the state they're in, so a replay only matches the original if they start out as the
+// recorded ones did, i.e. all down.
+type Player struct {
+	runner    *scenario.Runner
+	endpoints Reseeder
+	dir       string
+	logger    logging.Logger
+}
+
+type PlayerOption func(*Player)
+
+// WithDirectory is where recordings are looked for, usually the journal's directory. Without
+// it, every replay fails with ErrNoDirectory.
+func WithDirectory(dir string) PlayerOption {
+	return func(p *Player) {
+		p.dir = dir
+	}
+}
+
+func WithLogger(l logging.Logger) PlayerOption {
+	return func(p *Player) {
+		p.logger = l
+	}
+}
+
+func NewPlayer(runner *scenario.Runner, endpoints Reseeder, opts ...PlayerOption) *Player {
+	p := &Player{runner: runner, endpoints: endpoints, logger: logging.Discard()}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Replay stops any running scenario and plays the named recording at the given speed, which
+// must be 1.
+func (p *Player) Replay(recording string, speed float64) (scenario.Status, error) {
+	if p.dir == "" {
+		return scenario.Status{}, ErrNoDirectory
+	}
+	if recording == "" || recording != filepath.Base(recording) {
+		return scenario.Status{}, ErrBadRecording
+	}
+	s, seed, err := Load(filepath.Join(p.dir, recording), speed)
+	if err != nil {
+		return scenario.Status{}, err
+	}
+
+	if err := p.runner.Stop(); err != nil && !errors.Is(err, scenario.ErrNotRunning) {
+		return scenario.Status{}, err
+	}
+	if err := p.runner.Load(s); err != nil {
+		return scenario.Status{}, err
+	}
+	p.endpoints.Reseed(seed)
+	p.logger.Info("Replaying recording", "recording", recording, "speed", speed, "seed", seed)
+	if err := p.runner.Start(); err != nil {
+		return scenario.Status{}, err
+	}
+	return p.runner.Status(), nil
+}
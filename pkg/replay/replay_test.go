@@ -0,0 +1,219 @@
+package replay_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"endpoint-visualiser-server/pkg/clock"
+	"endpoint-visualiser-server/pkg/endpoint"
+	"endpoint-visualiser-server/pkg/event"
+	"endpoint-visualiser-server/pkg/journal"
+	"endpoint-visualiser-server/pkg/replay"
+	"endpoint-visualiser-server/pkg/scenario"
+)
+
+func writeJournal(t *testing.T, entries ...journal.Entry) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestLoadReplaysTheLastTake(t *testing.T) {
+	ms := func(n int64) int64 { return n * int64(time.Millisecond) }
+	path := writeJournal(t,
+		journal.Entry{Kind: journal.KindSession},
+		journal.Entry{Kind: journal.KindSeed, Seed: 1, ElapsedNS: 0},
+		journal.Entry{Kind: journal.KindEvent, EndpointID: 1, Event: "ConnectEvent", ElapsedNS: ms(100)},
+		journal.Entry{Kind: journal.KindSeed, Seed: 42, ElapsedNS: ms(1000)},
+		journal.Entry{Kind: journal.KindEvent, EndpointID: 2, Event: "ConnectEvent", ElapsedNS: ms(1200)},
+		journal.Entry{Kind: journal.KindMessage, EndpointID: 2, Payload: json.RawMessage(`{"id":"EndpointConnected"}`), ElapsedNS: ms(1201)},
+		journal.Entry{Kind: journal.KindEvent, EndpointID: 2, Event: "JitterEvent:50", ElapsedNS: ms(3000)},
+	)
+
+	s, seed, err := replay.Load(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seed != 42 {
+		t.Errorf("seed = %d, want 42", seed)
+	}
+
+	type step struct {
+		at        time.Duration
+		endpoints []int
+		event     string
+	}
+	var got []step
+	for _, s := range s.Steps {
+		got = append(got, step{time.Duration(s.At), s.Endpoints, s.Event})
+	}
+	want := []step{
+		{200 * time.Millisecond, []int{2}, "ConnectEvent"},
+		{2 * time.Second, []int{2}, "JitterEvent:50"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("steps = %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadOnlyAtTheRecordedSpeed(t *testing.T) {
+	path := writeJournal(t,
+		journal.Entry{Kind: journal.KindSeed, Seed: 1},
+		journal.Entry{Kind: journal.KindEvent, EndpointID: 1, Event: "ConnectEvent"},
+	)
+	if _, _, err := replay.Load(path, 2); !errors.Is(err, replay.ErrBadSpeed) {
+		t.Errorf("err = %v, want %v", err, replay.ErrBadSpeed)
+	}
+}
+
+func TestLoadNeedsASeed(t *testing.T) {
+	path := writeJournal(t,
+		journal.Entry{Kind: journal.KindSession},
+		journal.Entry{Kind: journal.KindEvent, EndpointID: 1, Event: "ConnectEvent"},
+	)
+	if _, _, err := replay.Load(path, 1); !errors.Is(err, replay.ErrNoSeed) {
+		t.Errorf("err = %v, want %v", err, replay.ErrNoSeed)
+	}
+}
+
+// trafficRecorder keeps the character of every traffic request, heartbeats aside, in order,
+// and passes each on to requests as it's sent.
+type trafficRecorder struct {
+	lock       sync.Mutex
+	characters []string
+	requests   chan string
+}
+
+func (r *trafficRecorder) GetSingleRequestSender(id int) func(interface{}) error {
+	return func(payload interface{}) error {
+		request, ok := payload.(endpoint.TrafficMessage)
+		if ok && request.ID == "TrafficRequest" && request.Character != "❤️" {
+			r.lock.Lock()
+			r.characters = append(r.characters, request.Character)
+			r.lock.Unlock()
+			r.requests <- request.Character
+		}
+		return nil
+	}
+}
+
+func (r *trafficRecorder) traffic() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.characters...)
+}
+
+func startManager(t *testing.T, seed int64, fakeClock *clock.Fake, opts ...endpoint.ManagerOption) (chan event.Event, *endpoint.Manager, *trafficRecorder) {
+	t.Helper()
+	eventChan := make(chan event.Event)
+	recorder := &trafficRecorder{requests: make(chan string, 64)}
+	opts = append([]endpoint.ManagerOption{
+		endpoint.WithConfig([]endpoint.ManagableEndpoint{{ID: 0, Title: "HSM", MaxConns: 64,
+			Generator: endpoint.GeneratorConfig{Name: endpoint.ConstantGenerator, RatePerSecond: 10}}}),
+		endpoint.WithWebSocketTarget(recorder),
+		endpoint.WithClock(fakeClock),
+		endpoint.WithSeed(seed),
+		endpoint.WithStatsInterval(0),
+	}, opts...)
+	manager := endpoint.NewManager(eventChan, opts...)
+	ctx, shutdown := context.WithCancel(context.Background())
+	t.Cleanup(shutdown)
+	manager.Start(ctx, &sync.WaitGroup{})
+	return eventChan, manager, recorder
+}
+
+const trafficRequests = 10
+
+// runTraffic steps the clock through a request every 100ms, until there have been
+// trafficRequests, then on to halfway to the next. Responses take 400ms, so up to 4 are
+// waiting on theirs. Before each step, it waits for those, the next request's and the
+// others' timers to be set, so none is set after the clock moves on.
+func runTraffic(t *testing.T, fakeClock *clock.Fake, recorder *trafficRecorder, others int) {
+	t.Helper()
+	for sent := 0; ; {
+		select {
+		case <-recorder.requests:
+			sent++
+		case <-time.After(time.Second):
+			t.Fatalf("request %d never came", sent+1)
+		}
+		inFlight := sent
+		if inFlight > 4 {
+			inFlight = 4
+		}
+		fakeClock.BlockUntil(1 + inFlight + others)
+		if sent == trafficRequests {
+			fakeClock.Advance(50 * time.Millisecond)
+			return
+		}
+		fakeClock.Advance(100 * time.Millisecond)
+	}
+}
+
+func TestReplayRepeatsTheRecordedTraffic(t *testing.T) {
+	dir := t.TempDir()
+	recordingClock := clock.NewFake(time.Unix(0, 0))
+	j, err := journal.Open(filepath.Join(dir, "journal.jsonl"), journal.WithClock(recordingClock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	eventChan, _, original := startManager(t, 42, recordingClock, endpoint.WithJournal(j))
+	send := func(e fmt.Stringer) {
+		// Waiting on the result means the event has been journalled.
+		result := make(chan error, 1)
+		eventChan <- event.Event{Destination: 0, Event: e, Result: result}
+		if err := <-result; err != nil {
+			t.Fatalf("%s: %s", e, err)
+		}
+	}
+	send(event.ConnectEvent{})
+	recordingClock.BlockUntil(2) // The next heartbeat and the response.
+	recordingClock.Advance(time.Second)
+	send(event.StartTrafficEvent{})
+	runTraffic(t, recordingClock, original, 0)
+	send(event.StopTrafficEvent{})
+
+	// A differently seeded manager, so the replay's traffic only matches if the seed is restored.
+	replayClock := clock.NewFake(time.Unix(0, 0))
+	replayChan, manager, replayed := startManager(t, 1, replayClock)
+	runner := scenario.NewRunner(replayChan, scenario.WithEndpoints([]int{0}), scenario.WithClock(replayClock))
+	if _, err := replay.NewPlayer(runner, manager, replay.WithDirectory(dir)).Replay("journal.jsonl", 1); err != nil {
+		t.Fatal(err)
+	}
+	replayClock.BlockUntil(3) // The next heartbeat, the response and StartTrafficEvent's step.
+	replayClock.Advance(time.Second)
+	runTraffic(t, replayClock, replayed, 1) // StopTrafficEvent's step is waiting too.
+	deadline := time.Now().Add(time.Second)
+	for runner.Status().State != "Finished" {
+		if time.Now().After(deadline) {
+			t.Fatalf("replay never finished, is %s", runner.Status().State)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	want, got := original.traffic(), replayed.traffic()
+	if len(want) != trafficRequests || !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed traffic %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,287 @@
+package scenario
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"endpoint-visualiser-server/pkg/clock"
+	"endpoint-visualiser-server/pkg/event"
+	"endpoint-visualiser-server/pkg/logging"
+)
+
+type runState string
+
+const (
+	stateStopped  runState = "Stopped"
+	stateRunning  runState = "Running"
+	statePaused   runState = "Paused"
+	stateFinished runState = "Finished"
+)
+
+var (
+	ErrNoScenario     = errors.New("no scenario loaded")
+	ErrNotRunning     = errors.New("scenario is not running")
+	ErrAlreadyRunning = errors.New("scenario is already running")
+	ErrNoSuchEndpoint = errors.New("no endpoint has id")
+)
+
+// Runner publishes a scenario's steps on the same event channel the keyboard listener uses.
+type Runner struct {
+	eventChan chan<- event.Event
+	logger    logging.Logger
+	clock     clock.Clock
+
+	control   sync.Mutex // Serialises Start, Pause and Stop.
+	lock      sync.Mutex // Guards everything below, shared with the run goroutine.
+	scenario  *Scenario
+	endpoints []int
+	state     runState
+	next      int           // Index of the next step to fire.
+	pending   []int         // Endpoints the next step is still to be sent to, nil until it fires.
+	elapsed   time.Duration // Scenario time at which the runner last stopped or paused.
+	started   time.Time     // Clock time the current run started, offset by elapsed.
+	cancel    chan struct{}
+	done      chan struct{}
+}
+
+type RunnerOption func(*Runner)
+
+func WithScenario(s Scenario) RunnerOption {
+	return func(r *Runner) {
+		r.scenario = &s
+	}
+}
+
+// WithEndpoints lists every endpoint ID, for steps that don't name their endpoints.
+func WithEndpoints(ids []int) RunnerOption {
+	return func(r *Runner) {
+		r.endpoints = ids
+	}
+}
+
+// SetEndpoints replaces the endpoint IDs from WithEndpoints, e.g. after a config reload.
+// A running scenario picks them up from its next step.
+func (r *Runner) SetEndpoints(ids []int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.endpoints = ids
+}
+
+func WithLogger(l logging.Logger) RunnerOption {
+	return func(r *Runner) {
+		r.logger = l
+	}
+}
+
+// WithClock times steps by c rather than the wall clock.
+func WithClock(c clock.Clock) RunnerOption {
+	return func(r *Runner) {
+		r.clock = c
+	}
+}
+
+func NewRunner(eventChan chan<- event.Event, opts ...RunnerOption) *Runner {
+	r := &Runner{eventChan: eventChan, state: stateStopped, logger: logging.Discard(), clock: clock.Real()}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Status describes where a runner is up to.
+type Status struct {
+	Scenario   string `json:"scenario,omitempty"`
+	State      string `json:"state"`
+	ElapsedMS  int64  `json:"elapsedMS"`
+	NextStep   int    `json:"nextStep"`
+	TotalSteps int    `json:"totalSteps"`
+}
+
+func (r *Runner) Status() Status {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	status := Status{State: string(r.state), NextStep: r.next, ElapsedMS: int64(r.elapsed / time.Millisecond)}
+	if r.scenario != nil {
+		status.Scenario = r.scenario.Name
+		status.TotalSteps = len(r.scenario.Steps)
+	}
+	if r.state == stateRunning {
+		status.ElapsedMS = int64(r.clock.Now().Sub(r.started) / time.Millisecond)
+	}
+	return status
+}
+
+// Start runs the scenario from the beginning, or resumes it if paused.
+func (r *Runner) Start() error {
+	r.control.Lock()
+	defer r.control.Unlock()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	switch {
+	case r.scenario == nil:
+		return ErrNoScenario
+	case r.state == stateRunning:
+		return ErrAlreadyRunning
+	}
+	// Checked again here, as a reload may have removed endpoints since the scenario was loaded.
+	if err := r.checkEndpoints(*r.scenario); err != nil {
+		return err
+	}
+	if r.state != statePaused {
+		r.next, r.pending, r.elapsed = 0, nil, 0
+	}
+
+	r.logger.Info("Scenario running", logging.Scenario, r.scenario.Name, logging.Step, r.next)
+	r.state = stateRunning
+	r.started = r.clock.Now().Add(-r.elapsed)
+	r.cancel, r.done = make(chan struct{}), make(chan struct{})
+	go r.run(r.cancel, r.done)
+	return nil
+}
+
+// Pause stops the clock, Start carries on from the same point.
+func (r *Runner) Pause() error {
+	r.control.Lock()
+	defer r.control.Unlock()
+
+	if r.currentState() != stateRunning {
+		return ErrNotRunning
+	}
+	r.halt()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.elapsed = r.clock.Now().Sub(r.started)
+	r.state = statePaused
+	r.logger.Info("Scenario paused", logging.Scenario, r.scenario.Name, logging.Step, r.next)
+	return nil
+}
+
+// Stop abandons the scenario, Start will begin again from the first step.
+func (r *Runner) Stop() error {
+	r.control.Lock()
+	defer r.control.Unlock()
+
+	state := r.currentState()
+	if state != stateRunning && state != statePaused {
+		return ErrNotRunning
+	}
+	if state == stateRunning {
+		r.halt()
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.state, r.next, r.pending, r.elapsed = stateStopped, 0, nil, 0
+	r.logger.Info("Scenario stopped", logging.Scenario, r.scenario.Name)
+	return nil
+}
+
+// Load replaces the scenario, unless one is running or paused, or it has steps for endpoints
+// that aren't configured.
+func (r *Runner) Load(s Scenario) error {
+	r.control.Lock()
+	defer r.control.Unlock()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.state == stateRunning || r.state == statePaused {
+		return ErrAlreadyRunning
+	}
+	if err := r.checkEndpoints(s); err != nil {
+		return err
+	}
+	r.scenario = &s
+	r.state, r.next, r.pending, r.elapsed = stateStopped, 0, nil, 0
+	r.logger.Info("Scenario loaded", logging.Scenario, s.Name, "steps", len(s.Steps))
+	return nil
+}
+
+// checkEndpoints can only check once WithEndpoints has said what there is. Callers must hold lock.
+func (r *Runner) checkEndpoints(s Scenario) error {
+	if r.endpoints == nil {
+		return nil
+	}
+	return s.CheckEndpoints(r.endpoints)
+}
+
+func (r *Runner) currentState() runState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.state
+}
+
+// halt stops the run goroutine. Callers must hold control but not lock, as run needs it to finish.
+func (r *Runner) halt() {
+	close(r.cancel)
+	<-r.done
+}
+
+func (r *Runner) run(cancel <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	for {
+		r.lock.Lock()
+		if r.next >= len(r.scenario.Steps) {
+			r.state = stateFinished
+			r.elapsed = r.clock.Now().Sub(r.started)
+			r.lock.Unlock()
+			r.logger.Info("Scenario finished", logging.Scenario, r.scenario.Name)
+			return
+		}
+		step := r.scenario.Steps[r.next]
+		wait := time.Duration(step.At) - r.clock.Now().Sub(r.started)
+		r.lock.Unlock()
+
+		timer := r.clock.NewTimer(wait)
+		select {
+		case <-timer.C():
+		case <-cancel:
+			timer.Stop()
+			return
+		}
+
+		if !r.publish(step, cancel) {
+			return
+		}
+	}
+}
+
+// publish sends the step to each of its endpoints, then moves on to the next step. If it's
+// cancelled part way, resuming carries on with the endpoints that haven't had it yet.
+func (r *Runner) publish(step Step, cancel <-chan struct{}) bool {
+	r.lock.Lock()
+	if r.pending == nil {
+		destinations := step.Endpoints
+		if len(destinations) == 0 {
+			destinations = r.endpoints
+		}
+		r.pending = append([]int{}, destinations...)
+	}
+	r.lock.Unlock()
+
+	for {
+		r.lock.Lock()
+		if len(r.pending) == 0 {
+			r.pending = nil
+			r.next++
+			r.lock.Unlock()
+			return true
+		}
+		id := r.pending[0]
+		r.lock.Unlock()
+
+		r.logger.Debug("Scenario sending event", logging.EndpointID, id, logging.Event, step.event.String())
+		select {
+		case r.eventChan <- event.Event{Destination: id, Event: step.event}:
+		case <-cancel:
+			return false
+		}
+		r.lock.Lock()
+		r.pending = r.pending[1:]
+		r.lock.Unlock()
+	}
+}
@@ -0,0 +1,179 @@
+package scenario
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"endpoint-visualiser-server/pkg/clock"
+	"endpoint-visualiser-server/pkg/event"
+)
+
+func TestRunnerPublishesStepsInOrder(t *testing.T) {
+
+	s := Scenario{Name: "test", Steps: []Step{
+		{At: Offset(60 * time.Millisecond), Endpoints: []int{2}, Event: "DelayLongEvent"},
+		{At: 0, Event: "ConnectEvent"},
+		{At: Offset(30 * time.Millisecond), Event: "StartTrafficEvent"},
+	}}
+	if err := s.prepare(); err != nil {
+		t.Fatalf("scenario invalid: %s", err)
+	}
+
+	eventChan := make(chan event.Event, 16)
+	runner := NewRunner(eventChan, WithScenario(s), WithEndpoints([]int{1, 2}))
+	if err := runner.Start(); err != nil {
+		t.Fatalf("start failed: %s", err)
+	}
+
+	expected := []string{"1 ConnectEvent", "2 ConnectEvent", "1 StartTrafficEvent", "2 StartTrafficEvent", "2 DelayLongEvent"}
+	for _, want := range expected {
+		select {
+		case e := <-eventChan:
+			if got := fmt.Sprintf("%d %s", e.Destination, e); got != want {
+				t.Fatalf("expected %s, got %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s, got nothing", want)
+		}
+	}
+
+	waitForState(t, runner, stateFinished)
+	if err := runner.Pause(); err != ErrNotRunning {
+		t.Fatalf("expected pausing a finished scenario to fail, got %v", err)
+	}
+}
+
+func TestRunnerPauseAndResume(t *testing.T) {
+
+	s := Scenario{Name: "test", Steps: []Step{
+		{At: 0, Endpoints: []int{1}, Event: "ConnectEvent"},
+		{At: Offset(100 * time.Millisecond), Endpoints: []int{1}, Event: "DisconnectEvent"},
+	}}
+	if err := s.prepare(); err != nil {
+		t.Fatalf("scenario invalid: %s", err)
+	}
+
+	eventChan := make(chan event.Event, 16)
+	runner := NewRunner(eventChan, WithScenario(s))
+	runner.Start()
+	<-eventChan
+	if err := runner.Pause(); err != nil {
+		t.Fatalf("pause failed: %s", err)
+	}
+
+	select {
+	case e := <-eventChan:
+		t.Fatalf("paused scenario sent %s", e)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := runner.Start(); err != nil {
+		t.Fatalf("resume failed: %s", err)
+	}
+	select {
+	case e := <-eventChan:
+		if e.String() != "DisconnectEvent" {
+			t.Fatalf("expected the scenario to resume, got %s", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("resumed scenario never sent its last step")
+	}
+
+	waitForState(t, runner, stateFinished)
+	if err := runner.Stop(); err != ErrNotRunning {
+		t.Fatalf("expected stopping a finished scenario to fail, got %v", err)
+	}
+}
+
+func TestRunnerResumesPartPublishedStep(t *testing.T) {
+
+	s := Scenario{Name: "test", Steps: []Step{
+		{At: 0, Endpoints: []int{1, 2, 3}, Event: "RaiseTPSEvent"},
+		{At: Offset(time.Second), Endpoints: []int{1}, Event: "DisconnectEvent"},
+	}}
+	if err := s.prepare(); err != nil {
+		t.Fatalf("scenario invalid: %s", err)
+	}
+
+	// Unbuffered, so the runner is part way through the first step when it's paused.
+	eventChan := make(chan event.Event)
+	fakeClock := clock.NewFake(time.Unix(0, 0))
+	runner := NewRunner(eventChan, WithScenario(s), WithClock(fakeClock))
+	runner.Start()
+	expectEvents(t, eventChan, "1 RaiseTPSEvent")
+	if err := runner.Pause(); err != nil {
+		t.Fatalf("pause failed: %s", err)
+	}
+
+	if err := runner.Start(); err != nil {
+		t.Fatalf("resume failed: %s", err)
+	}
+	expectEvents(t, eventChan, "2 RaiseTPSEvent", "3 RaiseTPSEvent")
+	fakeClock.BlockUntil(1)
+	if status := runner.Status(); status.NextStep != 1 || status.ElapsedMS != 0 {
+		t.Fatalf("expected to be waiting on the second step with the clock stopped, got %+v", status)
+	}
+	fakeClock.Advance(time.Second)
+	expectEvents(t, eventChan, "1 DisconnectEvent")
+	waitForState(t, runner, stateFinished)
+}
+
+func TestRunnerRejectsUnknownEndpoints(t *testing.T) {
+
+	s := Scenario{Name: "test", Steps: []Step{
+		{At: 0, Event: "ConnectEvent"},
+		{At: Offset(time.Second), Endpoints: []int{1, 3}, Event: "DisconnectEvent"},
+	}}
+	if err := s.prepare(); err != nil {
+		t.Fatalf("scenario invalid: %s", err)
+	}
+
+	runner := NewRunner(make(chan event.Event), WithEndpoints([]int{1, 2}))
+	if err := runner.Load(s); !errors.Is(err, ErrNoSuchEndpoint) {
+		t.Fatalf("expected loading a step for endpoint 3 to fail, got %v", err)
+	}
+
+	// Or once a reload has removed it.
+	runner = NewRunner(make(chan event.Event), WithEndpoints([]int{1, 3}))
+	if err := runner.Load(s); err != nil {
+		t.Fatalf("load failed: %s", err)
+	}
+	runner.SetEndpoints([]int{1, 2})
+	if err := runner.Start(); !errors.Is(err, ErrNoSuchEndpoint) {
+		t.Fatalf("expected starting a step for removed endpoint 3 to fail, got %v", err)
+	}
+}
+
+func expectEvents(t *testing.T, eventChan <-chan event.Event, expected ...string) {
+	t.Helper()
+	for _, want := range expected {
+		select {
+		case e := <-eventChan:
+			if got := fmt.Sprintf("%d %s", e.Destination, e); got != want {
+				t.Fatalf("expected %s, got %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s, got nothing", want)
+		}
+	}
+}
+
+func TestScenarioRejectsUnknownEvents(t *testing.T) {
+	s := Scenario{Steps: []Step{{At: 0, Event: "NotAnEvent"}}}
+	if err := s.prepare(); err == nil {
+		t.Fatalf("expected an unknown event to be rejected")
+	}
+}
+
+func waitForState(t *testing.T, runner *Runner, want runState) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runner.Status().State != string(want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("runner never reached %s, is %s", want, runner.Status().State)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,127 @@
+package scenario
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"time"
+
+	"endpoint-visualiser-server/pkg/event"
+)
+
+// Scenario is a timed sequence of events, e.g.
+//
+//	{
+//	    "name": "Slow HSM 2",
+//	    "steps": [
+//	        { "at": "0s", "event": "ConnectEvent" },
+//	        { "at": "5s", "event": "StartTrafficEvent" },
+//	        { "at": "20s", "endpoints": [2], "event": "DelayLongEvent" }
+//	    ]
+//	}
+//
+// A step with no endpoints applies to every endpoint.
+type Scenario struct {
+	Name  string `json:"name"`
+	Steps []Step `json:"steps"`
+}
+
+type Step struct {
+	At        Offset `json:"at"`
+	Endpoints []int  `json:"endpoints,omitempty"`
+	Event     string `json:"event"`
+
+	event fmt.Stringer
+}
+
+// Offset is how long after the start of the scenario a step fires. In JSON it's either a
+// duration string ("1m30s") or a number of milliseconds.
+type Offset time.Duration
+
+func (o *Offset) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*o = Offset(d)
+		return nil
+	}
+
+	ms, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return fmt.Errorf("offset must be a duration string or milliseconds, got %s", data)
+	}
+	*o = Offset(time.Duration(ms) * time.Millisecond)
+	return nil
+}
+
+func (o Offset) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(o).String())
+}
+
+// Load reads and validates a scenario file.
+func Load(path string) (Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Scenario{}, err
+	}
+
+	var s Scenario
+	if err := json.Unmarshal(data, &s); err != nil {
+		return Scenario{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := s.prepare(); err != nil {
+		return Scenario{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// New builds a scenario from steps, e.g. ones recorded rather than read from a file.
+func New(name string, steps []Step) (Scenario, error) {
+	s := Scenario{Name: name, Steps: steps}
+	if err := s.prepare(); err != nil {
+		return Scenario{}, err
+	}
+	return s, nil
+}
+
+// CheckEndpoints fails on the first step naming an endpoint that isn't in ids. Steps without
+// endpoints go to whatever endpoints there are, so they always pass.
+func (s Scenario) CheckEndpoints(ids []int) error {
+	known := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		known[id] = true
+	}
+	for _, step := range s.Steps {
+		for _, id := range step.Endpoints {
+			if !known[id] {
+				return fmt.Errorf("step at %s: %w %d", time.Duration(step.At), ErrNoSuchEndpoint, id)
+			}
+		}
+	}
+	return nil
+}
+
+// prepare checks every step's event and puts the steps in the order they fire.
+func (s *Scenario) prepare() error {
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("scenario has no steps")
+	}
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		if step.At < 0 {
+			return fmt.Errorf("step %d: offset must not be negative", i)
+		}
+		e, err := event.Lookup(step.Event)
+		if err != nil {
+			return fmt.Errorf("step %d: %w", i, err)
+		}
+		step.event = e
+	}
+	sort.SliceStable(s.Steps, func(i, j int) bool { return s.Steps[i].At < s.Steps[j].At })
+	return nil
+}